@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/chainguard-dev/tlogistry/internal/upstream"
+)
+
+// adminHandler serves the admin API, which requires the token as a bearer token.
+func adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/upstreams", handleUpstreams)
+	mux.HandleFunc("/admin/pins", handlePins)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			serveError(w, regError{status: http.StatusUnauthorized, Code: "UNAUTHORIZED", Message: "admin token required"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// handleUpstreams serves the upstream health scoreboard.
+func handleUpstreams(w http.ResponseWriter, _ *http.Request) {
+	serveJSON(w, upstream.Scores())
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chainguard-dev/tlogistry/internal/digests"
+	"github.com/chainguard-dev/tlogistry/internal/rekor"
+	"github.com/chainguard-dev/tlogistry/internal/upstream"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const (
+	helmConfigMediaType  = "application/vnd.cncf.helm.config.v1+json"
+	helmContentMediaType = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+
+	maxChartSize = 10 << 20 // 10MB
+)
+
+// charts serves a minimal Helm HTTP repository, whose index only includes
+// versions of the configured OCI charts that are pinned in Rekor.
+type charts struct {
+	repos []name.Repository
+	ttl   time.Duration
+
+	mu        sync.Mutex
+	index     *helmIndex
+	generated time.Time
+	packages  map[string]chartPackage // <name>-<version>.tgz -> package
+}
+
+type chartPackage struct {
+	repo   name.Repository
+	digest string // digest of the chart content layer.
+}
+
+type helmIndex struct {
+	APIVersion string                              `json:"apiVersion"`
+	Entries    map[string][]map[string]interface{} `json:"entries"`
+	Generated  time.Time                           `json:"generated"`
+}
+
+func newCharts(repos []string, ttl time.Duration) (*charts, error) {
+	c := &charts{ttl: ttl}
+	for _, r := range repos {
+		repo, err := name.NewRepository(r)
+		if err != nil {
+			return nil, fmt.Errorf("parsing chart repository %q: %w", r, err)
+		}
+		c.repos = append(c.repos, repo)
+	}
+	return c, nil
+}
+
+func (c *charts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Println("charts:", r.Method, r.URL)
+	ctx := r.Context()
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "tlogistry is read-only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	idx, pkgs, err := c.get(ctx)
+	if err != nil {
+		log.Println("!!! ERROR GENERATING CHART INDEX:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	file := strings.TrimPrefix(r.URL.Path, "/charts/")
+	switch file {
+	case "index.yaml":
+		// JSON is valid YAML, and Helm parses the index as such.
+		w.Header().Set("Content-Type", "application/x-yaml")
+		if err := json.NewEncoder(w).Encode(idx); err != nil {
+			log.Println("!!! ERROR WRITING CHART INDEX:", err)
+		}
+	default:
+		pkg, found := pkgs[file]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		b, err := fetchBlob(ctx, pkg.repo, pkg.digest, maxChartSize)
+		if err != nil {
+			log.Println("!!! ERROR FETCHING CHART:", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		if _, err := w.Write(b); err != nil {
+			log.Println("!!! ERROR WRITING CHART:", err)
+		}
+	}
+}
+
+// get returns the current index, regenerating it if it's stale.
+func (c *charts) get(ctx context.Context) (*helmIndex, map[string]chartPackage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.index != nil && time.Since(c.generated) < c.ttl {
+		return c.index, c.packages, nil
+	}
+
+	idx := &helmIndex{
+		APIVersion: "v1",
+		Entries:    map[string][]map[string]interface{}{},
+		Generated:  time.Now().UTC(),
+	}
+	pkgs := map[string]chartPackage{}
+	for _, repo := range c.repos {
+		if err := c.addRepo(ctx, repo, idx, pkgs); err != nil {
+			return nil, nil, fmt.Errorf("indexing %s: %w", repo, err)
+		}
+	}
+	for _, vs := range idx.Entries {
+		sort.Slice(vs, func(i, j int) bool { return fmt.Sprint(vs[i]["version"]) > fmt.Sprint(vs[j]["version"]) })
+	}
+	c.index, c.packages, c.generated = idx, pkgs, time.Now()
+	return idx, pkgs, nil
+}
+
+// addRepo adds every pinned version of the chart in repo to the index.
+func (c *charts) addRepo(ctx context.Context, repo name.Repository, idx *helmIndex, pkgs map[string]chartPackage) error {
+	resp, err := fetch(ctx, repo, "tags/list")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var tags struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return fmt.Errorf("decoding tags: %w", err)
+	}
+
+	for _, t := range tags.Tags {
+		tag := repo.Tag(t)
+		digest, info, err := rekor.Get(ctx, tag)
+		if err != nil {
+			return fmt.Errorf("looking up digest for tag %q: %w", tag, err)
+		}
+		if digest == "" {
+			continue // Only pinned versions are served.
+		}
+
+		m, err := fetchManifest(ctx, repo, digest)
+		if err != nil {
+			return err
+		}
+		if string(m.Config.MediaType) != helmConfigMediaType {
+			log.Printf("skipping %s: not a Helm chart (config mediaType %q)", tag, m.Config.MediaType)
+			continue
+		}
+		var content *v1.Descriptor
+		for i, l := range m.Layers {
+			if string(l.MediaType) == helmContentMediaType {
+				content = &m.Layers[i]
+				break
+			}
+		}
+		if content == nil {
+			log.Printf("skipping %s: no chart content layer", tag)
+			continue
+		}
+
+		b, err := fetchBlob(ctx, repo, m.Config.Digest.String(), maxChartSize)
+		if err != nil {
+			return err
+		}
+		// The config blob is the chart's Chart.yaml metadata, as JSON.
+		var meta map[string]interface{}
+		if err := json.Unmarshal(b, &meta); err != nil {
+			return fmt.Errorf("decoding chart metadata for %s: %w", tag, err)
+		}
+		chart, _ := meta["name"].(string)
+		version, _ := meta["version"].(string)
+		if chart == "" || version == "" {
+			log.Printf("skipping %s: chart metadata missing name or version", tag)
+			continue
+		}
+		file := fmt.Sprintf("%s-%s.tgz", chart, version)
+		if _, dup := pkgs[file]; dup {
+			log.Printf("skipping %s: %s already indexed", tag, file)
+			continue
+		}
+
+		meta["digest"] = content.Digest.Hex
+		meta["urls"] = []string{file}
+		meta["created"] = info.IntegratedTime.UTC()
+		idx.Entries[chart] = append(idx.Entries[chart], meta)
+		pkgs[file] = chartPackage{repo: repo, digest: content.Digest.String()}
+	}
+	return nil
+}
+
+var errNotFound = errors.New("not found")
+
+// fetch GETs the given path under repo from the upstream registry.
+func fetch(ctx context.Context, repo name.Repository, path string, accept ...string) (*http.Response, error) {
+	host := upstream.Route(repo.RegistryStr())
+	t, err := upstream.Token(host, repo.RepositoryStr())
+	if err != nil {
+		return nil, fmt.Errorf("getting token: %w", err)
+	}
+	url := fmt.Sprintf("https://%s/v2/%s/%s", host, repo.RepositoryStr(), path)
+	log.Println("  --> GET", url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if t != "" {
+		req.Header.Set("Authorization", "Bearer "+t)
+	}
+	for _, a := range accept {
+		req.Header.Add("Accept", a)
+	}
+	resp, err := upstream.Client.Do(req) // Blobs are commonly redirected to storage.
+	if err != nil {
+		return nil, err
+	}
+	log.Println("  <--", resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%w: %s", errNotFound, url)
+		}
+		return nil, fmt.Errorf("unexpected status code (%s): %d", url, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// fetchManifest fetches the OCI manifest by digest, and checks its content
+// against the digest.
+func fetchManifest(ctx context.Context, repo name.Repository, digest string) (*v1.Manifest, error) {
+	resp, err := fetch(ctx, repo, "manifests/"+digest, "application/vnd.oci.image.manifest.v1+json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := readVerified(resp.Body, digest, maxChartSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest %s: %w", digest, err)
+	}
+	return v1.ParseManifest(bytes.NewReader(b))
+}
+
+// fetchBlob fetches the blob by digest, and checks its content against the
+// digest.
+func fetchBlob(ctx context.Context, repo name.Repository, digest string, limit int64) ([]byte, error) {
+	resp, err := fetch(ctx, repo, "blobs/"+digest)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := readVerified(resp.Body, digest, limit)
+	if err != nil {
+		return nil, fmt.Errorf("reading blob %s: %w", digest, err)
+	}
+	return b, nil
+}
+
+// readVerified reads up to limit bytes, and checks that they match the digest.
+func readVerified(r io.Reader, digest string, limit int64) ([]byte, error) {
+	b, err := readLimited(r, limit)
+	if err != nil {
+		return nil, err
+	}
+	if err := digests.Verify(b, digest); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
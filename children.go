@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/chainguard-dev/tlogistry/internal/upstream"
+)
+
+// verifyChildren checks that the manifests of indexes served by tag exist
+// upstream, and reports them in TLog-Child headers.
+var verifyChildren bool
+
+const (
+	maxChildren      = 64
+	childConcurrency = 8
+)
+
+// childStatuses checks each manifest of the index in the response to req
+// with a HEAD request upstream, and returns a description of each, like
+// "sha256:...; platform=linux/amd64; status=ok". The response's body is read
+// and replaced, so it can still be served.
+func childStatuses(req *http.Request, resp *http.Response) ([]string, error) {
+	// Whatever's read is put back, even if the index is too large to check.
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+	if err != nil {
+		return nil, fmt.Errorf("reading index: %w", err)
+	}
+	if int64(len(b)) > maxManifestSize {
+		return nil, fmt.Errorf("index exceeds %d bytes", maxManifestSize)
+	}
+
+	var idx struct {
+		Manifests []struct {
+			MediaType string `json:"mediaType"`
+			Digest    string `json:"digest"`
+			Platform  *struct {
+				OS           string `json:"os"`
+				Architecture string `json:"architecture"`
+				Variant      string `json:"variant"`
+			} `json:"platform"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, fmt.Errorf("parsing index: %w", err)
+	}
+	if len(idx.Manifests) > maxChildren {
+		log.Printf("=== checking the first %d of %d manifests in index", maxChildren, len(idx.Manifests))
+		idx.Manifests = idx.Manifests[:maxChildren]
+	}
+
+	base := req.URL.String()[:strings.LastIndex(req.URL.String(), "/")+1]
+	out := make([]string, len(idx.Manifests))
+	sem := make(chan struct{}, childConcurrency)
+	var wg sync.WaitGroup
+	for i, m := range idx.Manifests {
+		desc := m.Digest
+		if p := m.Platform; p != nil {
+			platform := p.OS + "/" + p.Architecture
+			if p.Variant != "" {
+				platform += "/" + p.Variant
+			}
+			desc += "; platform=" + platform
+		}
+		wg.Add(1)
+		go func(i int, desc, digest, mediaType string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			out[i] = desc + "; status=" + childStatus(req, base+digest, digest, mediaType)
+		}(i, desc, m.Digest, m.MediaType)
+	}
+	wg.Wait()
+	return out, nil
+}
+
+// childStatus checks the manifest at url with a HEAD request, with req's
+// headers.
+func childStatus(req *http.Request, url, digest, mediaType string) string {
+	head, err := http.NewRequestWithContext(req.Context(), http.MethodHead, url, nil)
+	if err != nil {
+		return "error"
+	}
+	head.Header = req.Header.Clone()
+	head.Header.Del("Accept")
+	if mediaType != "" {
+		head.Header.Set("Accept", mediaType)
+	}
+	resp, err := upstream.Transport.RoundTrip(head)
+	if err != nil {
+		log.Printf("!!! ERROR CHECKING %s: %v", url, err)
+		return "error"
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "missing"
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Sprintf("error(%d)", resp.StatusCode)
+	case resp.Header.Get("Docker-Content-Digest") != "" && resp.Header.Get("Docker-Content-Digest") != digest:
+		return "mismatch"
+	}
+	return "ok"
+}
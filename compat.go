@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/chainguard-dev/tlogistry/internal/digests"
+	"github.com/chainguard-dev/tlogistry/internal/upstream"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// maxManifestSize is the largest manifest served or read.
+var maxManifestSize int64 = 4 << 20
+
+// schema1MediaTypes are Docker schema 1 manifest types. Registries sign them
+// as they're served, so their digests change from one pull to the next.
+var schema1MediaTypes = map[string]bool{
+	"application/vnd.docker.distribution.manifest.v1+json":      true,
+	"application/vnd.docker.distribution.manifest.v1+prettyjws": true,
+}
+
+var indexMediaTypes = map[string]bool{
+	"application/vnd.docker.distribution.manifest.list.v2+json": true,
+	"application/vnd.oci.image.index.v1+json":                   true,
+}
+
+// mediaType returns the media type without any parameters.
+func mediaType(s string) string {
+	return strings.TrimSpace(strings.SplitN(s, ";", 2)[0])
+}
+
+// manifestAccept returns the Accept header to send upstream for a manifest
+// request with the client's Accept headers.
+//
+// Clients send the types they accept as repeated headers (docker), one
+// comma-separated header (containerd), or both (podman); they're sent
+// upstream as one header. Schema 1 types are dropped. If the client doesn't
+// accept any other types, e.g., curl, all the types tlogistry knows are
+// accepted, since some registries serve schema 1 by default.
+func manifestAccept(values []string) string {
+	var types []string
+	seen := map[string]bool{}
+	wildcard := false
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			mt := mediaType(t)
+			switch {
+			case mt == "*/*":
+				wildcard = true
+			case mt == "" || schema1MediaTypes[mt] || seen[mt]:
+			default:
+				seen[mt] = true
+				types = append(types, strings.TrimSpace(t))
+			}
+		}
+	}
+	if len(types) == 0 {
+		types = append(types, manifestMediaTypes...)
+	}
+	if wildcard {
+		types = append(types, "*/*")
+	}
+	return strings.Join(types, ", ")
+}
+
+// acceptsIndexes reports whether the Accept header includes all the index
+// types, so the client is served whatever index a tag points to.
+func acceptsIndexes(accept string) bool {
+	n := 0
+	for _, t := range strings.Split(accept, ",") {
+		if indexMediaTypes[mediaType(t)] {
+			n++
+		}
+	}
+	return n == len(indexMediaTypes)
+}
+
+// manifestDigest returns the digest of the manifest in the response to req
+// with the algorithm, for registries that don't report it in
+// Docker-Content-Digest, or report it with another algorithm. The response
+// to a GET is read and replaced, so it can still be served; for a HEAD, the
+// manifest is fetched with a GET.
+func manifestDigest(req *http.Request, resp *http.Response, algorithm string) (string, error) {
+	if req.Method == http.MethodHead {
+		get := req.Clone(req.Context())
+		get.Method = http.MethodGet
+		gresp, err := upstream.Transport.RoundTrip(get)
+		if err != nil {
+			return "", err
+		}
+		defer gresp.Body.Close()
+		if gresp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("unexpected status code (%s): %d", get.URL, gresp.StatusCode)
+		}
+		if d := strings.TrimSpace(gresp.Header.Get("Docker-Content-Digest")); digests.Algorithm(d) == algorithm {
+			return d, nil
+		}
+		resp = gresp
+	}
+	b, err := readLimited(resp.Body, maxManifestSize)
+	if err != nil {
+		return "", fmt.Errorf("reading manifest: %w", err)
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	return digests.Of(algorithm, b)
+}
+
+// inIndex reports whether the manifest with the digest is one of the
+// manifests of the index (or manifest list) with the index digest. Clients
+// that don't accept indexes, like older Docker clients, are served one of a
+// tag's manifests instead of the index it points to.
+func inIndex(ctx context.Context, repo name.Repository, index, digest string) (bool, error) {
+	var accept []string
+	for mt := range indexMediaTypes {
+		accept = append(accept, mt)
+	}
+	resp, err := fetch(ctx, repo, "manifests/"+index, accept...)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if !indexMediaTypes[mediaType(resp.Header.Get("Content-Type"))] {
+		return false, nil
+	}
+	b, err := readVerified(resp.Body, index, maxManifestSize)
+	if err != nil {
+		return false, fmt.Errorf("reading index %s: %w", index, err)
+	}
+	var idx struct {
+		Manifests []struct {
+			Digest string `json:"digest"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return false, fmt.Errorf("parsing index %s: %w", index, err)
+	}
+	for _, m := range idx.Manifests {
+		if m.Digest == digest {
+			log.Printf("=== %s is in index %s", digest, index)
+			return true, nil
+		}
+	}
+	return false, nil
+}
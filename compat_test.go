@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+const fakeToken = "fake-token"
+
+// fakeUpstream wraps the fake registry with behaviors of real ones that
+// clients have to cope with: it requires a token, and like Docker Hub, it
+// serves the first manifest of an index to clients that don't accept
+// indexes. In repositories under nodigest/, it doesn't report manifests'
+// digests.
+type fakeUpstream struct {
+	registry http.Handler
+	tokens   int64 // Tokens issued.
+}
+
+func (u *fakeUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		atomic.AddInt64(&u.tokens, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"token": fakeToken, "expires_in": 300})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+fakeToken {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="fake"`, r.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method == http.MethodPut || !strings.Contains(r.URL.Path, "/manifests/") {
+		u.registry.ServeHTTP(w, r)
+		return
+	}
+
+	get := r.Clone(r.Context())
+	get.Method = http.MethodGet
+	rec := httptest.NewRecorder()
+	u.registry.ServeHTTP(rec, get)
+	ref := path.Base(r.URL.Path)
+	if ct := rec.Header().Get("Content-Type"); rec.Code == http.StatusOK && indexMediaTypes[ct] && !strings.HasPrefix(ref, "sha256:") && !strings.Contains(strings.Join(r.Header.Values("Accept"), ","), ct) {
+		var idx struct {
+			Manifests []struct {
+				Digest string `json:"digest"`
+			} `json:"manifests"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &idx); err != nil || len(idx.Manifests) == 0 {
+			http.Error(w, "bad index", http.StatusInternalServerError)
+			return
+		}
+		get.URL.Path = path.Join(path.Dir(r.URL.Path), idx.Manifests[0].Digest)
+		rec = httptest.NewRecorder()
+		u.registry.ServeHTTP(rec, get)
+	}
+	for k, v := range rec.Header() {
+		w.Header()[k] = v
+	}
+	if strings.Contains(r.URL.Path, "/nodigest/") {
+		w.Header().Del("Docker-Content-Digest")
+	}
+	w.WriteHeader(rec.Code)
+	if r.Method != http.MethodHead {
+		w.Write(rec.Body.Bytes())
+	}
+}
+
+const (
+	dockerList   = "application/vnd.docker.distribution.manifest.list.v2+json"
+	dockerV2     = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerSigned = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+)
+
+// clients are the Accept headers sent by clients with different quirks.
+var clients = []struct {
+	name   string
+	accept []string
+}{{
+	name:   "repeated headers without OCI index",
+	accept: []string{dockerV2, dockerList, ociManifest, dockerSigned},
+}, {
+	name:   "one header with wildcard",
+	accept: []string{strings.Join([]string{dockerV2, dockerList, ociManifest, ociIndex, "*/*"}, ", ")},
+}, {
+	name:   "repeated and combined headers with schema 1",
+	accept: []string{ociManifest + ", " + ociIndex, dockerV2, dockerList, "application/vnd.docker.distribution.manifest.v1+json", dockerSigned},
+}, {
+	name:   "schema 1 only",
+	accept: []string{dockerSigned},
+}, {
+	name: "no Accept header",
+}, {
+	name:   "with parameters",
+	accept: []string{ociIndex + "; q=0.9", ociManifest + ";q=0.5"},
+}}
+
+func withAccept(accept []string) func(*http.Request) {
+	return func(r *http.Request) {
+		for _, a := range accept {
+			r.Header.Add("Accept", a)
+		}
+	}
+}
+
+// TestClients checks that each client can resolve and pull single images
+// and indexes, HEAD-then-GET like containerd, and that they pin the same
+// digests whichever client pulls a tag first.
+func TestClients(t *testing.T) {
+	h := http.HandlerFunc(handler)
+	for i, c := range clients {
+		for _, kind := range []string{"image", "index", "nodigest/image", "nodigest/index"} {
+			t.Run(c.name+"/"+kind, func(t *testing.T) {
+				repo := fmt.Sprintf("compat/%d/%s", i, kind)
+				var want string
+				if strings.HasSuffix(kind, "index") {
+					want, _ = pushIndex(t, repo, "latest")
+				} else {
+					want = push(t, repo, "latest")
+				}
+
+				head := pull(h, http.MethodHead, repo, "latest", withAccept(c.accept))
+				checkStatus(t, head, http.StatusOK, "")
+				digest := head.Header().Get("Docker-Content-Digest")
+				if digest == "" {
+					t.Fatal("HEAD: Docker-Content-Digest is missing")
+				}
+				get := pull(h, http.MethodGet, repo, "latest", withAccept(c.accept))
+				checkStatus(t, get, http.StatusOK, "")
+				if got := get.Header().Get("Docker-Content-Digest"); got != digest {
+					t.Errorf("GET: Docker-Content-Digest = %q, want %q", got, digest)
+				}
+				if got := fmt.Sprintf("sha256:%x", sha256.Sum256(get.Body.Bytes())); got != digest {
+					t.Errorf("GET: manifest digest = %q, want %q", got, digest)
+				}
+				checkStatus(t, pull(h, http.MethodGet, repo, digest, withAccept(c.accept)), http.StatusOK, "")
+				checkPins(t, repo, "latest", want)
+
+				// Other clients can pull the tag too.
+				for _, other := range clients {
+					checkStatus(t, pull(h, http.MethodGet, repo, "latest", withAccept(other.accept)), http.StatusOK, "")
+				}
+				checkPins(t, repo, "latest", want)
+			})
+		}
+	}
+}
+
+// TestIndexMismatch checks that clients that don't accept indexes can't be
+// served manifests from outside the pinned index.
+func TestIndexMismatch(t *testing.T) {
+	h := http.HandlerFunc(handler)
+	repo := "compat/index-mismatch"
+	pinned, _ := pushIndex(t, repo, "latest")
+	checkStatus(t, pull(h, http.MethodGet, repo, "latest"), http.StatusOK, "")
+
+	// The tag is moved upstream.
+	pushIndex(t, repo, "latest")
+	for _, c := range clients {
+		checkStatus(t, pull(h, http.MethodGet, repo, "latest", withAccept(c.accept)), http.StatusBadRequest, "TAG_INVALID")
+	}
+	checkPins(t, repo, "latest", pinned)
+}
+
+// TestParallelBlobs checks that parallel blob fetches, like buildkit's,
+// share a token.
+func TestParallelBlobs(t *testing.T) {
+	h := http.HandlerFunc(handler)
+	repo := "compat/parallel"
+	var configs []string
+	for i := 0; i < 8; i++ {
+		var m struct {
+			Config struct {
+				Digest string `json:"digest"`
+			} `json:"config"`
+		}
+		if err := json.Unmarshal(image(t, repo), &m); err != nil {
+			t.Fatal(err)
+		}
+		configs = append(configs, m.Config.Digest)
+	}
+
+	before := atomic.LoadInt64(&upstreamRegistry.tokens)
+	var wg sync.WaitGroup
+	for _, d := range configs {
+		wg.Add(1)
+		go func(d string) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/v2/%s/%s/blobs/%s", registryHost, repo, d), nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Errorf("GET %s: status = %d, want 200", d, w.Code)
+			}
+		}(d)
+	}
+	wg.Wait()
+	if got := atomic.LoadInt64(&upstreamRegistry.tokens) - before; got != 1 {
+		t.Errorf("got %d tokens, want 1", got)
+	}
+}
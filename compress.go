@@ -0,0 +1,140 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// minCompressSize is the smallest response worth compressing, if its size
+// is known.
+const minCompressSize = 1 << 10
+
+// compressible reports whether responses of the content type are compressed,
+// if the client accepts it: manifests, JSON and HTML, which compress well.
+func compressible(contentType string) bool {
+	mt := mediaType(contentType)
+	return strings.HasSuffix(mt, "+json") || mt == "application/json" || mt == "text/html"
+}
+
+// acceptsGzip reports whether the client accepts gzip, per its
+// Accept-Encoding header. zstd isn't offered, since there's no encoder in
+// the standard library.
+func acceptsGzip(r *http.Request) bool {
+	q := map[string]float64{}
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, e := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(e, ";")
+			c := strings.ToLower(strings.TrimSpace(coding))
+			q[c] = 1
+			if p := strings.TrimSpace(params); strings.HasPrefix(p, "q=") {
+				if f, err := strconv.ParseFloat(strings.TrimPrefix(p, "q="), 64); err == nil {
+					q[c] = f
+				}
+			}
+		}
+	}
+	if v, ok := q["gzip"]; ok {
+		return v > 0
+	}
+	return q["*"] > 0
+}
+
+// withCompression gzips responses that are worth compressing, if the client
+// accepts it.
+func withCompression(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.Close()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+// gzipWriter decides whether to compress when the response's headers are
+// written, and if so compresses its body.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	hdr := w.Header()
+	size, err := strconv.ParseInt(hdr.Get("Content-Length"), 10, 64)
+	if status == http.StatusOK &&
+		hdr.Get("Content-Encoding") == "" && // Already compressed.
+		compressible(hdr.Get("Content-Type")) &&
+		(err != nil || size >= minCompressSize) {
+		hdr.Set("Content-Encoding", "gzip")
+		hdr.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Close flushes the compressed body, if it's compressed.
+func (w *gzipWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
+
+func (w *gzipWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// decodeBody undoes any compression of an upstream response, which isn't
+// asked for but might be sent anyway, so that manifests can be hashed and
+// responses recompressed for the client. Only gzip can be undone.
+func decodeBody(resp *http.Response) error {
+	switch enc := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return fmt.Errorf("decompressing response: %w", err)
+		}
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{zr, resp.Body}
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		return nil
+	default:
+		return fmt.Errorf("unsupported content encoding %q", enc)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"GZIP", true},
+		{"zstd", false},
+		{"gzip;q=0", false},
+		{"*", true},
+		{"*;q=0, gzip", true},
+		{"gzip;q=0, *", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.header != "" {
+			r.Header.Set("Accept-Encoding", c.header)
+		}
+		if got := acceptsGzip(r); got != c.want {
+			t.Errorf("acceptsGzip(%q) = %t, want %t", c.header, got, c.want)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	large := `{"schemaVersion":2,"manifests":[` + strings.Repeat(`{"size":1},`, 200) + `{}]}`
+	for _, c := range []struct {
+		desc, accept, contentType, body string
+		wantGzip                        bool
+	}{
+		{"gzip", "gzip", ociIndex, large, true},
+		{"not accepted", "", ociIndex, large, false},
+		{"small", "gzip", ociIndex, "{}", false},
+		{"not compressible", "gzip", "application/octet-stream", large, false},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			h := withCompression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", c.contentType)
+				w.Header().Set("Content-Length", strconv.Itoa(len(c.body)))
+				io.WriteString(w, c.body)
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept-Encoding", c.accept)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+			if gzipped := w.Header().Get("Content-Encoding") == "gzip"; gzipped != c.wantGzip {
+				t.Fatalf("Content-Encoding = %q, want gzip %t", w.Header().Get("Content-Encoding"), c.wantGzip)
+			}
+			body := w.Body.Bytes()
+			if c.wantGzip {
+				zr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(body) != c.body {
+				t.Errorf("body = %q, want %q", body, c.body)
+			}
+		})
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	io.WriteString(zw, "{}")
+	zw.Close()
+	resp := &http.Response{
+		Header:        http.Header{"Content-Encoding": {"gzip"}, "Content-Length": {strconv.Itoa(buf.Len())}},
+		ContentLength: int64(buf.Len()),
+		Body:          io.NopCloser(&buf),
+	}
+	if err := decodeBody(resp); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(resp.Body); err != nil || string(b) != "{}" {
+		t.Errorf("body = %q, %v, want {}", b, err)
+	}
+	if resp.Header.Get("Content-Encoding") != "" || resp.ContentLength != -1 {
+		t.Errorf("Content-Encoding = %q, ContentLength = %d", resp.Header.Get("Content-Encoding"), resp.ContentLength)
+	}
+
+	resp = &http.Response{Header: http.Header{"Content-Encoding": {"zstd"}}, Body: http.NoBody}
+	if err := decodeBody(resp); err == nil {
+		t.Error("decodeBody(zstd) succeeded, want error")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"time"
+
+	"github.com/chainguard-dev/tlogistry/internal/audit"
+	"github.com/chainguard-dev/tlogistry/internal/rekor"
+)
+
+// showDashboard controls whether live statistics are shown on the home page.
+var showDashboard bool
+
+var dashboardTmpl = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return time.Since(t).Round(time.Second).String() + " ago"
+	},
+}).Parse(`<hr>
+<h2 id="live-stats">Live Stats</h2>
+<p>As seen by this instance:</p>
+<ul>
+<li>Pins recorded today: <strong>{{.PinsToday}}</strong></li>
+<li>Mismatches today: <strong>{{.MismatchesToday}}</strong></li>
+<li>Rekor: <strong>{{if .Rekor.Healthy}}healthy{{else}}unhealthy{{end}}</strong>
+  (last success {{ago .Rekor.LastSuccess}}, last failure {{ago .Rekor.LastFailure}}, last latency {{.Rekor.LastLatency}})</li>
+</ul>
+{{if .TopRepos}}<h3>Top Repos</h3>
+<table>
+<tr><th>Repo</th><th>Pulls</th></tr>
+{{range .TopRepos}}<tr><td><code>{{.Repo}}</code></td><td>{{.Pulls}}</td></tr>
+{{end}}</table>
+{{end}}{{if .Mismatches}}<h3>Recent Mismatches</h3>
+<table>
+<tr><th>When</th><th>Tag</th><th>Got</th><th>Pinned</th></tr>
+{{range .Mismatches}}<tr><td>{{ago .Time}}</td><td><code>{{.Tag}}</code></td><td><code>{{.Digest}}</code></td><td><code>{{.Want}}</code></td></tr>
+{{end}}</table>
+{{end}}`))
+
+// writeDashboard renders live statistics from the audit log and Rekor health.
+func writeDashboard(w io.Writer) error {
+	return dashboardTmpl.Execute(w, struct {
+		PinsToday, MismatchesToday int64
+		Rekor                      rekor.Health
+		TopRepos                   []audit.RepoCount
+		Mismatches                 []audit.Event
+	}{
+		PinsToday:       audit.Today(audit.Pinned),
+		MismatchesToday: audit.Today(audit.Mismatch),
+		Rekor:           rekor.CurrentHealth(),
+		TopRepos:        audit.TopRepos(10),
+		Mismatches:      audit.Recent(audit.Mismatch, 10),
+	})
+}
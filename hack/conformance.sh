@@ -0,0 +1,49 @@
+#!/usr/bin/env bash
+# Runs the pull workflows of the OCI distribution-spec conformance suite
+# (https://github.com/opencontainers/distribution-spec/tree/main/conformance)
+# against a running tlogistry instance, e.g.:
+#
+#   OCI_ROOT_URL=http://localhost:8080 OCI_NAMESPACE=ghcr.io/example/app ./hack/conformance.sh
+#
+# tlogistry is read-only, so the suite can't push its own test content.
+# Instead it pulls OCI_TAG_NAME (default latest) of OCI_NAMESPACE, which is
+# both the upstream repository and its path through tlogistry, and the tag's
+# manifest and config blob are looked up upstream with crane. The tag should
+# point to a single-platform image, or set OCI_MANIFEST_DIGEST and
+# OCI_BLOB_DIGEST yourself.
+#
+# Pulling the tag pins it, like any other pull through the instance.
+#
+# Reports are written to CONFORMANCE_RESULTS (default ./conformance-results).
+set -euo pipefail
+
+: "${OCI_ROOT_URL:=http://localhost:8080}"
+: "${OCI_NAMESPACE:?set OCI_NAMESPACE to an upstream repository, e.g., ghcr.io/example/app}"
+: "${OCI_TAG_NAME:=latest}"
+: "${CONFORMANCE_VERSION:=v1.1.0}"
+: "${CONFORMANCE_RESULTS:=$PWD/conformance-results}"
+crane="go run github.com/google/go-containerregistry/cmd/crane@v0.10.0"
+
+if [[ -z "${OCI_MANIFEST_DIGEST:-}" ]]; then
+  OCI_MANIFEST_DIGEST=$($crane digest "${OCI_NAMESPACE}:${OCI_TAG_NAME}")
+fi
+if [[ -z "${OCI_BLOB_DIGEST:-}" ]]; then
+  OCI_BLOB_DIGEST=$($crane manifest "${OCI_NAMESPACE}@${OCI_MANIFEST_DIGEST}" | jq -r '.config.digest // empty')
+  if [[ -z "${OCI_BLOB_DIGEST}" ]]; then
+    echo "${OCI_NAMESPACE}:${OCI_TAG_NAME} has no config blob; is it an index? Set OCI_BLOB_DIGEST." >&2
+    exit 1
+  fi
+fi
+
+work=$(mktemp -d)
+trap 'rm -rf "${work}"' EXIT
+git clone --quiet --depth 1 --branch "${CONFORMANCE_VERSION}" \
+  https://github.com/opencontainers/distribution-spec "${work}/distribution-spec"
+(cd "${work}/distribution-spec/conformance" && go test -c -o "${work}/conformance.test")
+
+mkdir -p "${CONFORMANCE_RESULTS}"
+cd "${CONFORMANCE_RESULTS}"
+export OCI_ROOT_URL OCI_NAMESPACE OCI_TAG_NAME OCI_MANIFEST_DIGEST OCI_BLOB_DIGEST
+export OCI_TEST_PULL=1 OCI_TEST_PUSH=0 OCI_TEST_CONTENT_DISCOVERY=0 OCI_TEST_CONTENT_MANAGEMENT=0
+export OCI_HIDE_SKIPPED_WORKFLOWS=1
+"${work}/conformance.test"
@@ -0,0 +1,151 @@
+// Package audit keeps an in-memory record of notable events, like tags being
+// pinned for the first time and digest mismatches.
+package audit
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Kind is the kind of an Event.
+type Kind string
+
+const (
+	// Pinned means a tag's digest was recorded in Rekor for the first time.
+	Pinned Kind = "pinned"
+	// Mismatch means a tag's current digest didn't match its pinned digest.
+	Mismatch Kind = "mismatch"
+	// Denied means a manifest wasn't served because the policy denied it.
+	Denied Kind = "denied"
+	// ConfigReloaded means the configuration file changed, and was reloaded.
+	ConfigReloaded Kind = "config-reloaded"
+)
+
+// maxEvents is the number of recent events kept in memory.
+const maxEvents = 1000
+
+// Event is a notable thing that happened.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Kind   Kind      `json:"kind"`
+	Repo   string    `json:"repo"`
+	Tag    string    `json:"tag"`
+	Digest string    `json:"digest"`
+	// Want is the pinned digest, for mismatches.
+	Want string `json:"want,omitempty"`
+	// UUID is the associated Rekor entry, if any.
+	UUID string `json:"uuid,omitempty"`
+	// Detail describes the event, e.g., what changed in the configuration.
+	Detail string `json:"detail,omitempty"`
+}
+
+var (
+	mu     sync.Mutex
+	sinks  []func(Event)
+	events []Event
+	pulls  = map[string]int64{} // repo -> manifest-by-tag pulls
+	today  string
+	counts = map[Kind]int64{} // events today, by kind
+)
+
+// Record records the event.
+func Record(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	switch {
+	case e.Digest == "":
+		log.Printf("=== AUDIT: %s: %s", e.Kind, e.Detail)
+	case e.Detail != "":
+		log.Printf("=== AUDIT: %s %s %s (want %q): %s", e.Kind, e.Tag, e.Digest, e.Want, e.Detail)
+	default:
+		log.Printf("=== AUDIT: %s %s %s (want %q)", e.Kind, e.Tag, e.Digest, e.Want)
+	}
+
+	mu.Lock()
+	events = append(events, e)
+	if len(events) > maxEvents {
+		events = events[len(events)-maxEvents:]
+	}
+	rollover(e.Time)
+	counts[e.Kind]++
+	s := sinks
+	mu.Unlock()
+
+	for _, f := range s {
+		f(e)
+	}
+}
+
+// AddSink has every event recorded from now on passed to f, which mustn't
+// block.
+func AddSink(f func(Event)) {
+	mu.Lock()
+	defer mu.Unlock()
+	sinks = append(sinks, f)
+}
+
+// Pulled records that a manifest was pulled by tag from the repo.
+func Pulled(repo string) {
+	mu.Lock()
+	defer mu.Unlock()
+	pulls[repo]++
+}
+
+// rollover resets daily counts when the (UTC) day changes.
+func rollover(t time.Time) {
+	if d := t.UTC().Format("2006-01-02"); d != today {
+		today = d
+		counts = map[Kind]int64{}
+	}
+}
+
+// Today returns the number of events of the given kind recorded today (UTC).
+func Today(k Kind) int64 {
+	mu.Lock()
+	defer mu.Unlock()
+	rollover(time.Now())
+	return counts[k]
+}
+
+// Recent returns up to n of the most recent events of the given kind, most
+// recent first.
+func Recent(k Kind, n int) []Event {
+	mu.Lock()
+	defer mu.Unlock()
+	var out []Event
+	for i := len(events) - 1; i >= 0 && len(out) < n; i-- {
+		if events[i].Kind == k {
+			out = append(out, events[i])
+		}
+	}
+	return out
+}
+
+// RepoCount is the number of pulls of a repo.
+type RepoCount struct {
+	Repo  string `json:"repo"`
+	Pulls int64  `json:"pulls"`
+}
+
+// TopRepos returns up to n of the most pulled repos since startup.
+func TopRepos(n int) []RepoCount {
+	mu.Lock()
+	defer mu.Unlock()
+	out := make([]RepoCount, 0, len(pulls))
+	for r, c := range pulls {
+		out = append(out, RepoCount{Repo: r, Pulls: c})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Pulls != out[j].Pulls {
+			return out[i].Pulls > out[j].Pulls
+		}
+		return out[i].Repo < out[j].Repo
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
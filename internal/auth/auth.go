@@ -0,0 +1,143 @@
+// Package auth implements optional authentication of clients of the
+// registry, so the principal that caused a tag to be pinned can be recorded.
+//
+// Clients can authenticate with:
+//   - an API key, as the password of HTTP Basic auth with the key's ID as the username
+//   - an OIDC ID token, as a Bearer token or as the password of HTTP Basic auth
+//   - a SPIFFE ID, from the X-Forwarded-Client-Cert header set by a trusted mTLS-terminating proxy
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/chainguard-dev/tlogistry/internal/secrets"
+	"github.com/kelseyhightower/envconfig"
+)
+
+var env struct {
+	// APIKeys maps API key IDs to the hex-encoded SHA-256 of the key.
+	APIKeys map[string]string `envconfig:"AUTH_API_KEYS"`
+	// APIKeysSecret is a secret reference whose value is more API keys, in
+	// the same id:sha256hex,... format, which is re-read when it rotates.
+	APIKeysSecret string `envconfig:"AUTH_API_KEYS_SECRET"`
+	// OIDCIssuer, if set, is trusted to issue ID tokens for clients.
+	OIDCIssuer   string `envconfig:"AUTH_OIDC_ISSUER"`
+	OIDCAudience string `envconfig:"AUTH_OIDC_AUDIENCE" default:"tlogistry"`
+	// TrustXFCC trusts the X-Forwarded-Client-Cert header for SPIFFE IDs.
+	// Only enable this if a proxy in front of tlogistry sets (and strips) it.
+	TrustXFCC bool `envconfig:"AUTH_TRUST_XFCC"`
+}
+
+func init() {
+	if err := envconfig.Process("", &env); err != nil {
+		log.Fatalf("envconfig: %v", err)
+	}
+}
+
+// Enabled reports whether clients are required to authenticate.
+func Enabled() bool {
+	return len(env.APIKeys) > 0 || env.APIKeysSecret != "" || env.OIDCIssuer != "" || env.TrustXFCC
+}
+
+type principalKey struct{}
+
+// Principal returns the authenticated principal for the request context, or
+// "" if the client didn't authenticate.
+func Principal(ctx context.Context) string {
+	p, _ := ctx.Value(principalKey{}).(string)
+	return p
+}
+
+// Middleware requires clients to authenticate if auth is enabled, and records
+// the principal in the request context.
+//
+// Since the client's credentials are meant for tlogistry and not upstream
+// registries, they're removed from the request.
+func Middleware(h http.Handler, unauthorized func(http.ResponseWriter)) http.Handler {
+	if !Enabled() {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := authenticate(r)
+		if err != nil {
+			log.Println("!!! AUTH FAILED:", err)
+		}
+		if p == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="tlogistry"`)
+			unauthorized(w)
+			return
+		}
+		log.Println("authenticated:", p)
+		r.Header.Del("Authorization")
+		r.Header.Del("X-Forwarded-Client-Cert")
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// authenticate returns the principal for the request, or "" if there isn't one.
+func authenticate(r *http.Request) (string, error) {
+	if env.TrustXFCC {
+		if id := spiffeID(r.Header.Get("X-Forwarded-Client-Cert")); id != "" {
+			return id, nil
+		}
+	}
+
+	if user, pass, ok := r.BasicAuth(); ok {
+		if want, found := apiKey(r.Context(), user); found {
+			got := sha256.Sum256([]byte(pass))
+			if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(got[:])), []byte(strings.ToLower(want))) == 1 {
+				return "apikey:" + user, nil
+			}
+			return "", nil
+		}
+		if env.OIDCIssuer != "" {
+			return verifyIDToken(r.Context(), pass)
+		}
+		return "", nil
+	}
+
+	if tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); tok != r.Header.Get("Authorization") && env.OIDCIssuer != "" {
+		return verifyIDToken(r.Context(), tok)
+	}
+	return "", nil
+}
+
+// apiKey returns the hex-encoded SHA-256 of the API key with the ID.
+func apiKey(ctx context.Context, id string) (string, bool) {
+	if want, found := env.APIKeys[id]; found {
+		return want, true
+	}
+	if env.APIKeysSecret == "" {
+		return "", false
+	}
+	keys, err := secrets.Resolve(ctx, env.APIKeysSecret)
+	if err != nil {
+		log.Println("!!! ERROR RESOLVING API KEYS:", err)
+		return "", false
+	}
+	for _, pair := range strings.Split(strings.TrimSpace(keys), ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(pair), ":"); ok && k == id {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// spiffeID returns the SPIFFE ID from the first element of an Envoy-style
+// X-Forwarded-Client-Cert header, e.g., `By=...;Hash=...;URI=spiffe://example.org/workload`.
+func spiffeID(xfcc string) string {
+	first := strings.SplitN(xfcc, ",", 2)[0]
+	for _, kv := range strings.Split(first, ";") {
+		k, v, ok := strings.Cut(kv, "=")
+		if ok && strings.EqualFold(k, "URI") && strings.HasPrefix(strings.Trim(v, `"`), "spiffe://") {
+			return strings.Trim(v, `"`)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keysTTL is how long the issuer's signing keys are cached.
+const keysTTL = time.Hour
+
+var (
+	keysMu      sync.Mutex
+	keys        map[string]crypto.PublicKey // kid -> key
+	keysFetched time.Time
+)
+
+// verifyIDToken verifies the token was issued by the configured issuer for
+// the configured audience, and returns the principal it identifies.
+func verifyIDToken(ctx context.Context, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed ID token")
+	}
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return "", fmt.Errorf("decoding ID token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("decoding ID token signature: %w", err)
+	}
+	key, err := signingKey(ctx, hdr.Kid)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if hdr.Alg != "RS256" {
+			return "", fmt.Errorf("unsupported alg %q for RSA key", hdr.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig); err != nil {
+			return "", fmt.Errorf("verifying ID token: %w", err)
+		}
+	case *ecdsa.PublicKey:
+		if hdr.Alg != "ES256" || len(sig) != 64 {
+			return "", fmt.Errorf("unsupported alg %q for EC key", hdr.Alg)
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, h[:], r, s) {
+			return "", errors.New("verifying ID token: invalid signature")
+		}
+	default:
+		return "", fmt.Errorf("unsupported key type %T", key)
+	}
+
+	var claims struct {
+		Iss string      `json:"iss"`
+		Sub string      `json:"sub"`
+		Aud interface{} `json:"aud"` // string or []string
+		Exp int64       `json:"exp"`
+		Nbf int64       `json:"nbf"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("decoding ID token claims: %w", err)
+	}
+	now := time.Now().Unix()
+	switch {
+	case claims.Iss != env.OIDCIssuer:
+		return "", fmt.Errorf("unexpected issuer %q", claims.Iss)
+	case !hasAudience(claims.Aud, env.OIDCAudience):
+		return "", fmt.Errorf("unexpected audience %v", claims.Aud)
+	case now > claims.Exp:
+		return "", errors.New("ID token expired")
+	case claims.Nbf != 0 && now < claims.Nbf:
+		return "", errors.New("ID token not yet valid")
+	case claims.Sub == "":
+		return "", errors.New("ID token has no subject")
+	}
+	return "oidc:" + claims.Sub, nil
+}
+
+func hasAudience(aud interface{}, want string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == want
+	case []interface{}:
+		for _, v := range a {
+			if v == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// signingKey returns the issuer's signing key with the given ID, refreshing
+// the cached keys if needed.
+func signingKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	if k, found := keys[kid]; found && time.Since(keysFetched) < keysTTL {
+		return k, nil
+	}
+	ks, err := fetchKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetching issuer keys: %w", err)
+	}
+	keys, keysFetched = ks, time.Now()
+	k, found := keys[kid]
+	if !found {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	return k, nil
+}
+
+func fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var disco struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := getJSON(ctx, strings.TrimSuffix(env.OIDCIssuer, "/")+"/.well-known/openid-configuration", &disco); err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := getJSON(ctx, disco.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	out := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				continue
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil {
+				continue
+			}
+			out[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil {
+				continue
+			}
+			y, err := base64.RawURLEncoding.DecodeString(k.Y)
+			if err != nil {
+				continue
+			}
+			out[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return out, nil
+}
+
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code (%s): %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
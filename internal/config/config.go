@@ -0,0 +1,212 @@
+// Package config loads tlogistry's configuration file, for settings that are
+// too structured for environment variables.
+//
+// The file is JSON, and its path is given by the CONFIG_FILE environment
+// variable, or it's read from the secret given by CONFIG_SECRET, either a
+// reference (see package secrets) or a GCP Secret Manager secret version. If neither is set, the zero Config is used.
+//
+// The configuration is reloaded when it changes, without interrupting
+// requests that are using the old one.
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/chainguard-dev/tlogistry/internal/audit"
+	"github.com/chainguard-dev/tlogistry/internal/secrets"
+	"github.com/kelseyhightower/envconfig"
+)
+
+// Config is tlogistry's configuration.
+type Config struct {
+	// Upstreams configures requests to upstream registries, by host.
+	Upstreams map[string]Upstream `json:"upstreams,omitempty"`
+
+	// Domains configures vanity domains served by tlogistry, by host.
+	Domains map[string]Domain `json:"domains,omitempty"`
+
+	// Subdomains maps the first label of the request's host to the
+	// registry it serves, e.g., "ghcr" routes ghcr.tlog.example.com/org/app
+	// to ghcr.io/org/app.
+	Subdomains map[string]string `json:"subdomains,omitempty"`
+}
+
+// Mismatch policies.
+const (
+	// Enforce fails requests whose digest doesn't match the pin.
+	Enforce = "enforce"
+	// Warn serves requests whose digest doesn't match the pin, but reports
+	// the mismatch.
+	Warn = "warn"
+	// ServePinned serves the pinned manifest instead of the tag's current
+	// one, and reports the mismatch.
+	ServePinned = "serve-pinned"
+)
+
+// Domain configures a vanity domain that's CNAME'd to tlogistry.
+type Domain struct {
+	// Registry is prefixed to repositories requested through the domain,
+	// e.g., "ghcr.io/example" serves "ghcr.io/example/app" as "app".
+	Registry string `json:"registry"`
+	// MismatchPolicy is Enforce, Warn or ServePinned. It defaults to the
+	// instance's MISMATCH_POLICY.
+	MismatchPolicy string `json:"mismatchPolicy,omitempty"`
+	// ValidationToken must be published in a TXT record at
+	// _tlogistry-challenge.<domain> to prove control of the domain before
+	// it's served.
+	ValidationToken string `json:"validationToken"`
+}
+
+// Upstream configures requests to an upstream registry.
+type Upstream struct {
+	// Headers are added to every request to the upstream. Values can be
+	// secret references, like gcp-sm://..., vault://... or file://...
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+var env struct {
+	File   string `envconfig:"CONFIG_FILE"`
+	Secret string `envconfig:"CONFIG_SECRET"`
+	// ReloadInterval is how often the configuration is checked for
+	// changes, or zero to never reload it.
+	ReloadInterval time.Duration `envconfig:"CONFIG_RELOAD_INTERVAL" default:"30s"`
+}
+
+var current atomic.Value // *Config
+
+func init() {
+	if err := envconfig.Process("", &env); err != nil {
+		log.Fatalf("envconfig: %v", err)
+	}
+	if env.File == "" && env.Secret == "" {
+		current.Store(&Config{})
+		return
+	}
+	b, err := read()
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	c, err := parse(b)
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	current.Store(c)
+	if env.ReloadInterval > 0 {
+		go watch(sha256.Sum256(b))
+	}
+}
+
+// Load reads the configuration file at path.
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+func parse(b []byte) (*Config, error) {
+	var c Config
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("parsing config: %w", err)
+	}
+	return &c, nil
+}
+
+// read reads the raw configuration from the file or secret.
+func read() ([]byte, error) {
+	if env.File != "" {
+		return os.ReadFile(env.File)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	ref := env.Secret
+	if !secrets.IsRef(ref) {
+		ref = "gcp-sm://" + ref
+	}
+	s, err := secrets.Fetch(ctx, ref)
+	return []byte(s), err
+}
+
+// watch reloads the configuration whenever it changes from the one with the
+// given hash. Invalid configurations are ignored, leaving the current one
+// in place.
+func watch(last [sha256.Size]byte) {
+	for range time.Tick(env.ReloadInterval) {
+		b, err := read()
+		if err != nil {
+			log.Println("!!! ERROR READING CONFIG:", err)
+			continue
+		}
+		h := sha256.Sum256(b)
+		if h == last {
+			continue
+		}
+		c, err := parse(b)
+		if err != nil {
+			log.Println("!!! ERROR RELOADING CONFIG:", err)
+			continue
+		}
+		old := Get()
+		current.Store(c)
+		last = h
+		audit.Record(audit.Event{Kind: audit.ConfigReloaded, Detail: strings.Join(diff(old, c), "; ")})
+	}
+}
+
+// diff describes what changed between the configurations, by key. Values
+// aren't included, since they can be secret.
+func diff(old, new *Config) []string {
+	var changes []string
+	section := func(name string, o, n map[string]string) {
+		for k, v := range n {
+			if ov, ok := o[k]; !ok {
+				changes = append(changes, fmt.Sprintf("added %s %q", name, k))
+			} else if ov != v {
+				changes = append(changes, fmt.Sprintf("changed %s %q", name, k))
+			}
+		}
+		for k := range o {
+			if _, ok := n[k]; !ok {
+				changes = append(changes, fmt.Sprintf("removed %s %q", name, k))
+			}
+		}
+	}
+	section("upstream", fingerprints(old.Upstreams), fingerprints(new.Upstreams))
+	section("domain", fingerprints(old.Domains), fingerprints(new.Domains))
+	section("subdomain", old.Subdomains, new.Subdomains)
+	sort.Strings(changes)
+	if len(changes) == 0 {
+		changes = []string{"no effective changes"}
+	}
+	return changes
+}
+
+// fingerprints returns the JSON encoding of each value of the map, for
+// comparison.
+func fingerprints(m interface{}) map[string]string {
+	out := map[string]string{}
+	v := reflect.ValueOf(m)
+	for _, k := range v.MapKeys() {
+		b, _ := json.Marshal(v.MapIndex(k).Interface())
+		out[k.String()] = string(b)
+	}
+	return out
+}
+
+// Get returns the current configuration.
+func Get() *Config { return current.Load().(*Config) }
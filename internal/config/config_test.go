@@ -0,0 +1,30 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	old := &Config{
+		Upstreams:  map[string]Upstream{"a.example.com": {Headers: map[string]string{"X-Key": "1"}}},
+		Domains:    map[string]Domain{"images.example.com": {Registry: "ghcr.io/example"}},
+		Subdomains: map[string]string{"ghcr": "ghcr.io", "dockerhub": "index.docker.io"},
+	}
+	new := &Config{
+		Upstreams:  map[string]Upstream{"a.example.com": {Headers: map[string]string{"X-Key": "2"}}},
+		Domains:    map[string]Domain{"images.example.com": {Registry: "ghcr.io/example"}},
+		Subdomains: map[string]string{"ghcr": "ghcr.io", "quay": "quay.io"},
+	}
+	want := []string{
+		`added subdomain "quay"`,
+		`changed upstream "a.example.com"`,
+		`removed subdomain "dockerhub"`,
+	}
+	if got := diff(old, new); !reflect.DeepEqual(got, want) {
+		t.Errorf("diff: got %q, want %q", got, want)
+	}
+	if got := diff(new, new); !reflect.DeepEqual(got, []string{"no effective changes"}) {
+		t.Errorf("diff(same): got %q", got)
+	}
+}
@@ -0,0 +1,104 @@
+// Package digests parses and checks content digests, like sha256:... and
+// sha512:..., without assuming an algorithm.
+package digests
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// Canonical is the algorithm of digests tlogistry computes itself.
+const Canonical = "sha256"
+
+// algorithms are the supported algorithms.
+var algorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Parse splits the digest into its algorithm and hex-encoded hash, and checks
+// that the algorithm is supported and the hash has the algorithm's length.
+func Parse(d string) (algorithm, encoded string, err error) {
+	algorithm, encoded, ok := strings.Cut(d, ":")
+	if !ok {
+		return "", "", fmt.Errorf("invalid digest %q", d)
+	}
+	h, ok := algorithms[algorithm]
+	if !ok {
+		return "", "", fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+	if len(encoded) != 2*h().Size() || strings.ToLower(encoded) != encoded {
+		return "", "", fmt.Errorf("invalid %s digest %q", algorithm, d)
+	}
+	if _, err := hex.DecodeString(encoded); err != nil {
+		return "", "", fmt.Errorf("invalid %s digest %q", algorithm, d)
+	}
+	return algorithm, encoded, nil
+}
+
+// Valid reports whether the digest is well-formed, with a supported
+// algorithm.
+func Valid(d string) bool {
+	_, _, err := Parse(d)
+	return err == nil
+}
+
+// Algorithm returns the digest's algorithm, or "" if it's not valid.
+func Algorithm(d string) string {
+	a, _, _ := Parse(d)
+	return a
+}
+
+// Of returns the digest of b with the algorithm.
+func Of(algorithm string, b []byte) (string, error) {
+	h, ok := algorithms[algorithm]
+	if !ok {
+		return "", fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+	hh := h()
+	hh.Write(b)
+	return fmt.Sprintf("%s:%x", algorithm, hh.Sum(nil)), nil
+}
+
+// Verify checks that b matches the digest, with the digest's algorithm.
+func Verify(b []byte, d string) error {
+	algorithm, _, err := Parse(d)
+	if err != nil {
+		return err
+	}
+	got, _ := Of(algorithm, b)
+	if got != d {
+		return fmt.Errorf("digest mismatch; got %q, want %q", got, d)
+	}
+	return nil
+}
+
+// Verifier hashes what's written to it, to check it against a digest
+// without holding it all in memory.
+type Verifier struct {
+	d string
+	h hash.Hash
+}
+
+// NewVerifier returns a Verifier for the digest.
+func NewVerifier(d string) (*Verifier, error) {
+	algorithm, _, err := Parse(d)
+	if err != nil {
+		return nil, err
+	}
+	return &Verifier{d: d, h: algorithms[algorithm]()}, nil
+}
+
+func (v *Verifier) Write(p []byte) (int, error) { return v.h.Write(p) }
+
+// Verify checks that what's been written matches the digest.
+func (v *Verifier) Verify() error {
+	if got := fmt.Sprintf("%s:%x", Algorithm(v.d), v.h.Sum(nil)); got != v.d {
+		return fmt.Errorf("digest mismatch; got %q, want %q", got, v.d)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package digests
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, c := range []struct {
+		digest, algorithm string
+	}{
+		{"sha256:" + strings.Repeat("a", 64), "sha256"},
+		{"sha512:" + strings.Repeat("0", 128), "sha512"},
+		{"sha256:" + strings.Repeat("a", 128), ""},
+		{"sha512:" + strings.Repeat("a", 64), ""},
+		{"sha256:" + strings.Repeat("A", 64), ""},
+		{"sha256:" + strings.Repeat("g", 64), ""},
+		{"md5:" + strings.Repeat("a", 32), ""},
+		{strings.Repeat("a", 64), ""},
+		{"", ""},
+	} {
+		if got := Algorithm(c.digest); got != c.algorithm {
+			t.Errorf("Algorithm(%q) = %q, want %q", c.digest, got, c.algorithm)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	b := []byte("hello")
+	for _, algorithm := range []string{"sha256", "sha512"} {
+		d, err := Of(algorithm, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Verify(b, d); err != nil {
+			t.Errorf("Verify(%s): %v", d, err)
+		}
+		if err := Verify([]byte("goodbye"), d); err == nil {
+			t.Errorf("Verify(%s) of other content: got nil error", d)
+		}
+	}
+	if _, err := Of("md5", b); err == nil {
+		t.Error("Of(md5): got nil error")
+	}
+}
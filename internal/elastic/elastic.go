@@ -0,0 +1,255 @@
+// Package elastic exports audit events, like new pins and mismatches, to an
+// Elasticsearch or OpenSearch index, for dashboards and alerting in existing
+// SIEM stacks.
+//
+// Events are queued, and written in batches with the _bulk API. If the
+// queue is full, or a batch can't be written after a few tries, events are
+// dropped rather than holding up requests.
+package elastic
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chainguard-dev/tlogistry/internal/audit"
+	"github.com/chainguard-dev/tlogistry/internal/metrics"
+	"github.com/chainguard-dev/tlogistry/internal/secrets"
+	"github.com/kelseyhightower/envconfig"
+)
+
+// Mapping is the index's mapping, which is applied when the index is
+// created.
+//
+//go:embed mapping.json
+var Mapping []byte
+
+const (
+	maxBatch   = 500
+	maxRetries = 3
+)
+
+var env struct {
+	// URL is the Elasticsearch or OpenSearch endpoint, e.g.,
+	// https://search.example.com:9200.
+	URL   string `envconfig:"ELASTICSEARCH_URL"`
+	Index string `envconfig:"ELASTICSEARCH_INDEX" default:"tlogistry-events"`
+	// APIKey, or Username and Password, authenticate to the endpoint, and
+	// can be secret references.
+	APIKey   string `envconfig:"ELASTICSEARCH_API_KEY"`
+	Username string `envconfig:"ELASTICSEARCH_USERNAME"`
+	Password string `envconfig:"ELASTICSEARCH_PASSWORD"`
+	// Kinds are the kinds of events exported.
+	Kinds         []string      `envconfig:"ELASTICSEARCH_EVENTS" default:"pinned,mismatch"`
+	FlushInterval time.Duration `envconfig:"ELASTICSEARCH_FLUSH_INTERVAL" default:"5s"`
+	QueueSize     int           `envconfig:"ELASTICSEARCH_QUEUE_SIZE" default:"10000"`
+}
+
+var (
+	mExported = metrics.NewCounter("tlogistry_elastic_events_total",
+		"Audit events sent to Elasticsearch, by result.", "result")
+
+	kinds  = map[audit.Kind]bool{}
+	queue  chan audit.Event
+	client = &http.Client{Timeout: 30 * time.Second}
+)
+
+func init() {
+	if err := envconfig.Process("", &env); err != nil {
+		log.Fatalf("envconfig: %v", err)
+	}
+	env.URL = strings.TrimSuffix(env.URL, "/")
+	for _, k := range env.Kinds {
+		kinds[audit.Kind(strings.TrimSpace(k))] = true
+	}
+}
+
+// Enabled reports whether events are exported.
+func Enabled() bool { return env.URL != "" }
+
+// Start creates the index if it doesn't exist, and exports events recorded
+// from now on.
+func Start() {
+	queue = make(chan audit.Event, env.QueueSize)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := createIndex(ctx); err != nil {
+		// Events can still be written if the index is created some
+		// other way, e.g., by an index template.
+		log.Printf("!!! ERROR CREATING INDEX %q: %v", env.Index, err)
+	}
+	audit.AddSink(enqueue)
+	go run()
+}
+
+// enqueue queues the event for export, if it's of a kind that's exported.
+func enqueue(e audit.Event) {
+	if !kinds[e.Kind] {
+		return
+	}
+	select {
+	case queue <- e:
+	default:
+		mExported.Inc("dropped")
+	}
+}
+
+// run writes queued events in batches, whenever a batch is full or
+// FlushInterval passes.
+func run() {
+	tick := time.NewTicker(env.FlushInterval)
+	defer tick.Stop()
+	var batch []audit.Event
+	for {
+		select {
+		case e := <-queue:
+			if batch = append(batch, e); len(batch) < maxBatch {
+				continue
+			}
+		case <-tick.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		flush(batch)
+		batch = nil
+	}
+}
+
+// flush writes the batch, retrying with backoff.
+func flush(batch []audit.Event) {
+	var err error
+	for i := 0; i < maxRetries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * time.Second)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err = bulk(ctx, batch)
+		cancel()
+		if err == nil {
+			return
+		}
+	}
+	log.Printf("!!! ERROR EXPORTING %d EVENTS: %v", len(batch), err)
+	mExported.Add(float64(len(batch)), "dropped")
+}
+
+// document is how an event is indexed.
+type document struct {
+	Timestamp time.Time `json:"@timestamp"`
+	Kind      string    `json:"kind"`
+	Repo      string    `json:"repo,omitempty"`
+	Tag       string    `json:"tag,omitempty"`
+	Digest    string    `json:"digest,omitempty"`
+	Want      string    `json:"want,omitempty"`
+	UUID      string    `json:"uuid,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// bulk writes the events with one _bulk request.
+func bulk(ctx context.Context, events []audit.Event) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range events {
+		action := map[string]interface{}{"create": map[string]string{"_index": env.Index}}
+		if err := enc.Encode(action); err != nil {
+			return err
+		}
+		if err := enc.Encode(document{
+			Timestamp: e.Time.UTC(),
+			Kind:      string(e.Kind),
+			Repo:      e.Repo,
+			Tag:       e.Tag,
+			Digest:    e.Digest,
+			Want:      e.Want,
+			UUID:      e.UUID,
+			Detail:    e.Detail,
+		}); err != nil {
+			return err
+		}
+	}
+	resp, err := do(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", &buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, b)
+	}
+	var br struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  *struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&br); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	failed := 0
+	for _, item := range br.Items {
+		for _, r := range item {
+			if r.Error != nil {
+				// Retrying won't help rejected documents.
+				failed++
+				log.Printf("!!! ERROR EXPORTING EVENT: %s: %s", r.Error.Type, r.Error.Reason)
+			}
+		}
+	}
+	mExported.Add(float64(len(events)-failed), "ok")
+	mExported.Add(float64(failed), "rejected")
+	return nil
+}
+
+// createIndex creates the index with Mapping, unless it already exists.
+func createIndex(ctx context.Context) error {
+	resp, err := do(ctx, http.MethodPut, "/"+env.Index, "application/json", bytes.NewReader(Mapping))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		log.Printf("=== created index %q", env.Index)
+		return nil
+	case resp.StatusCode == http.StatusBadRequest && bytes.Contains(b, []byte("resource_already_exists_exception")):
+		return nil
+	}
+	return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, b)
+}
+
+// do sends an authenticated request to the endpoint.
+func do(ctx context.Context, method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, env.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	switch {
+	case env.APIKey != "":
+		key, err := secrets.Resolve(ctx, env.APIKey)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "ApiKey "+key)
+	case env.Username != "":
+		password, err := secrets.Resolve(ctx, env.Password)
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth(env.Username, password)
+	}
+	return client.Do(req)
+}
@@ -0,0 +1,84 @@
+package elastic
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/tlogistry/internal/audit"
+)
+
+func TestExport(t *testing.T) {
+	var indexed []map[string]interface{}
+	var mapping map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "tlogistry" || pass != "hunter2" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/events":
+			if mapping != nil {
+				http.Error(w, `{"error":{"type":"resource_already_exists_exception"}}`, http.StatusBadRequest)
+				return
+			}
+			json.NewDecoder(r.Body).Decode(&mapping)
+		case r.Method == http.MethodPost && r.URL.Path == "/_bulk":
+			s := bufio.NewScanner(r.Body)
+			var items []interface{}
+			for s.Scan() {
+				var action map[string]map[string]string
+				if err := json.Unmarshal(s.Bytes(), &action); err != nil || action["create"]["_index"] != "events" {
+					t.Errorf("action = %s, want create in events", s.Bytes())
+				}
+				s.Scan()
+				var doc map[string]interface{}
+				if err := json.Unmarshal(s.Bytes(), &doc); err != nil {
+					t.Errorf("document = %s: %v", s.Bytes(), err)
+				}
+				indexed = append(indexed, doc)
+				items = append(items, map[string]interface{}{"create": map[string]int{"status": 201}})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": false, "items": items})
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	defer func(old string) { env.URL, env.Index, env.Username, env.Password = old, "", "", "" }(env.URL)
+	env.URL, env.Index, env.Username, env.Password = srv.URL, "events", "tlogistry", "hunter2"
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := createIndex(ctx); err != nil {
+			t.Fatalf("createIndex: %v", err)
+		}
+	}
+	if _, ok := mapping["mappings"]; !ok {
+		t.Errorf("mapping = %v, want Mapping", mapping)
+	}
+
+	at := time.Date(2022, 6, 28, 13, 3, 37, 0, time.UTC)
+	if err := bulk(ctx, []audit.Event{
+		{Time: at, Kind: audit.Pinned, Repo: "example.com/app", Tag: "example.com/app:v1", Digest: "sha256:aaaa", UUID: "1234"},
+		{Time: at, Kind: audit.Mismatch, Repo: "example.com/app", Tag: "example.com/app:v1", Digest: "sha256:bbbb", Want: "sha256:aaaa"},
+	}); err != nil {
+		t.Fatalf("bulk: %v", err)
+	}
+	if len(indexed) != 2 {
+		t.Fatalf("indexed %d documents, want 2", len(indexed))
+	}
+	if got := indexed[0]["@timestamp"]; got != "2022-06-28T13:03:37Z" {
+		t.Errorf("@timestamp = %v", got)
+	}
+	if got := indexed[1]["want"]; got != "sha256:aaaa" || indexed[1]["kind"] != "mismatch" {
+		t.Errorf("mismatch document = %v", indexed[1])
+	}
+	if _, ok := indexed[0]["want"]; ok {
+		t.Errorf("pinned document = %v, want no want", indexed[0])
+	}
+}
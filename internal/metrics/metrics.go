@@ -0,0 +1,237 @@
+// Package metrics implements a minimal set of Prometheus metrics, exposed
+// in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+}
+
+// Handler serves all registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		registryMu.Lock()
+		ms := append([]metric(nil), registry...)
+		registryMu.Unlock()
+		for _, m := range ms {
+			m.write(w)
+		}
+	})
+}
+
+// vec holds values of a metric by label values.
+type vec struct {
+	name, help, typ string
+	labels          []string
+
+	mu     sync.Mutex
+	values map[string]float64 // joined label values -> value
+}
+
+func newVec(name, help, typ string, labels []string) *vec {
+	return &vec{name: name, help: help, typ: typ, labels: labels, values: map[string]float64{}}
+}
+
+func (v *vec) key(lvs []string) string {
+	if len(lvs) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", v.name, len(lvs), len(v.labels)))
+	}
+	return strings.Join(lvs, "\xff")
+}
+
+func (v *vec) add(d float64, lvs []string) {
+	k := v.key(lvs)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[k] += d
+}
+
+func (v *vec) set(x float64, lvs []string) {
+	k := v.key(lvs)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[k] = x
+}
+
+func (v *vec) get(lvs []string) float64 {
+	k := v.key(lvs)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.values[k]
+}
+
+func (v *vec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.typ)
+	for _, k := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, labelString(v.labels, k, "", ""), formatFloat(v.values[k]))
+	}
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct{ v *vec }
+
+// NewCounter registers a new counter with the given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newVec(name, help, "counter", labels)}
+	register(c.v)
+	return c
+}
+
+// Inc increments the counter for the label values.
+func (c *Counter) Inc(labelValues ...string) { c.v.add(1, labelValues) }
+
+// Add adds d (which must not be negative) to the counter for the label values.
+func (c *Counter) Add(d float64, labelValues ...string) { c.v.add(d, labelValues) }
+
+// Value returns the current value of the counter for the label values.
+func (c *Counter) Value(labelValues ...string) float64 { return c.v.get(labelValues) }
+
+// Gauge is a value that can go up and down.
+type Gauge struct{ v *vec }
+
+// NewGauge registers a new gauge with the given label names.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newVec(name, help, "gauge", labels)}
+	register(g.v)
+	return g
+}
+
+// Set sets the gauge for the label values.
+func (g *Gauge) Set(x float64, labelValues ...string) { g.v.set(x, labelValues) }
+
+// Add adds d to the gauge for the label values.
+func (g *Gauge) Add(d float64, labelValues ...string) { g.v.add(d, labelValues) }
+
+// Value returns the current value of the gauge for the label values.
+func (g *Gauge) Value(labelValues ...string) float64 { return g.v.get(labelValues) }
+
+// DefBuckets are the default histogram buckets, in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	counts []uint64 // per bucket, not cumulative.
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a new histogram with the given buckets and label names.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*series{}}
+	register(h)
+	return h
+}
+
+// Observe records an observation for the label values.
+func (h *Histogram) Observe(x float64, labelValues ...string) {
+	if len(labelValues) != len(h.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", h.name, len(labelValues), len(h.labels)))
+	}
+	k := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[k]
+	if !ok {
+		s = &series{counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	for i, b := range h.buckets {
+		if x <= b {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += x
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		var cum uint64
+		for i, b := range h.buckets {
+			cum += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, k, "le", formatFloat(b)), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, k, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelString(h.labels, k, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, k, "", ""), s.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelString formats the labels for the joined label values, plus an extra
+// label if extraName isn't empty.
+func labelString(names []string, joined, extraName, extraValue string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(joined, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", names[i], v))
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return fmt.Sprintf("%g", f)
+}
@@ -0,0 +1,155 @@
+// Package policy asks an Open Policy Agent server whether to serve images,
+// so organizations can express nuanced serve/deny rules in Rego.
+package policy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+var env struct {
+	// URL is the OPA Data API URL of the policy decision, e.g.,
+	// http://localhost:8181/v1/data/tlogistry/decision. If it's not set,
+	// every request is allowed.
+	URL string `envconfig:"POLICY_URL"`
+	// CacheTTL is how long decisions are cached for the same input.
+	CacheTTL time.Duration `envconfig:"POLICY_CACHE_TTL" default:"1m"`
+	// FailOpen allows requests when the policy can't be evaluated.
+	FailOpen bool `envconfig:"POLICY_FAIL_OPEN"`
+	// Timeout is how long to wait for a decision.
+	Timeout time.Duration `envconfig:"POLICY_TIMEOUT" default:"5s"`
+}
+
+func init() {
+	if err := envconfig.Process("", &env); err != nil {
+		log.Fatalf("envconfig: %v", err)
+	}
+}
+
+// Enabled reports whether requests are subject to a policy.
+func Enabled() bool { return env.URL != "" }
+
+// Input is the document the policy is evaluated against.
+type Input struct {
+	Method    string `json:"method"`
+	Repo      string `json:"repo"`
+	Tag       string `json:"tag,omitempty"`
+	Digest    string `json:"digest"`
+	Principal string `json:"principal,omitempty"`
+	// Pinned is whether the tag was already pinned before this request.
+	Pinned bool `json:"pinned"`
+	// PinAge is how long ago the tag was pinned, in seconds.
+	PinAge int64 `json:"pinAge,omitempty"`
+	// Identity is the identity of the cert that signed the pin.
+	Identity string `json:"identity,omitempty"`
+	// Mismatch is the pinned digest, if it doesn't match Digest.
+	Mismatch string      `json:"mismatch,omitempty"`
+	Scan     interface{} `json:"scan,omitempty"`
+}
+
+// Decision is the policy's decision.
+type Decision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+}
+
+var cache struct {
+	sync.Mutex
+	m map[[sha256.Size]byte]cached
+}
+
+type cached struct {
+	d       Decision
+	expires time.Time
+}
+
+// maxCached is the most decisions that are cached.
+const maxCached = 10000
+
+// Decide evaluates the policy against the input.
+//
+// The policy's result is either a boolean, or an object like
+// {"allow": false, "reason": "..."}.
+func Decide(ctx context.Context, in Input) (Decision, error) {
+	b, err := json.Marshal(map[string]interface{}{"input": in})
+	if err != nil {
+		return Decision{}, err
+	}
+	key := sha256.Sum256(b)
+	cache.Lock()
+	if c, ok := cache.m[key]; ok && time.Now().Before(c.expires) {
+		cache.Unlock()
+		return c.d, nil
+	}
+	cache.Unlock()
+
+	d, err := query(ctx, b)
+	if err != nil {
+		if env.FailOpen {
+			log.Println("!!! ERROR EVALUATING POLICY, ALLOWING:", err)
+			return Decision{Allow: true, Reason: "policy unavailable"}, nil
+		}
+		return Decision{}, err
+	}
+
+	cache.Lock()
+	if cache.m == nil || len(cache.m) >= maxCached {
+		cache.m = map[[sha256.Size]byte]cached{}
+	}
+	cache.m[key] = cached{d: d, expires: time.Now().Add(env.CacheTTL)}
+	cache.Unlock()
+	return d, nil
+}
+
+func query(ctx context.Context, body []byte) (Decision, error) {
+	ctx, cancel := context.WithTimeout(ctx, env.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, env.URL, bytes.NewReader(body))
+	if err != nil {
+		return Decision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return Decision{}, fmt.Errorf("evaluating policy: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return Decision{}, fmt.Errorf("evaluating policy: unexpected status code %d: %s", resp.StatusCode, b)
+	}
+	var out struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil {
+		return Decision{}, fmt.Errorf("decoding policy result: %w", err)
+	}
+	return parseResult(out.Result)
+}
+
+// parseResult parses the policy's result, which is either a boolean or a
+// Decision.
+func parseResult(r json.RawMessage) (Decision, error) {
+	if len(r) == 0 {
+		return Decision{}, fmt.Errorf("policy is undefined at %s", env.URL)
+	}
+	var allow bool
+	if err := json.Unmarshal(r, &allow); err == nil {
+		return Decision{Allow: allow}, nil
+	}
+	var d Decision
+	if err := json.Unmarshal(r, &d); err != nil {
+		return Decision{}, fmt.Errorf("decoding policy result: %w", err)
+	}
+	return d, nil
+}
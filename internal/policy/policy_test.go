@@ -0,0 +1,53 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDecide(t *testing.T) {
+	var calls int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		var body struct{ Input Input }
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+		switch body.Input.Repo {
+		case "bool":
+			w.Write([]byte(`{"result": true}`))
+		case "object":
+			w.Write([]byte(`{"result": {"allow": false, "reason": "too new"}}`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer s.Close()
+	defer func(url string, ttl time.Duration) { env.URL, env.CacheTTL = url, ttl }(env.URL, env.CacheTTL)
+	env.URL, env.CacheTTL = s.URL, time.Minute
+	ctx := context.Background()
+
+	if d, err := Decide(ctx, Input{Repo: "bool"}); err != nil || !d.Allow {
+		t.Errorf("Decide(bool): got %+v, %v", d, err)
+	}
+	if d, err := Decide(ctx, Input{Repo: "object"}); err != nil || d.Allow || d.Reason != "too new" {
+		t.Errorf("Decide(object): got %+v, %v", d, err)
+	}
+	if _, err := Decide(ctx, Input{Repo: "undefined"}); err == nil {
+		t.Error("Decide(undefined): got nil error")
+	}
+
+	// Decisions are cached.
+	before := atomic.LoadInt32(&calls)
+	if d, err := Decide(ctx, Input{Repo: "object"}); err != nil || d.Allow {
+		t.Errorf("Decide(object): got %+v, %v", d, err)
+	}
+	if after := atomic.LoadInt32(&calls); after != before {
+		t.Errorf("Decide(object) wasn't cached: %d calls, want %d", after, before)
+	}
+}
@@ -0,0 +1,190 @@
+// Package referrers publishes pins as OCI referrers of the pinned manifests,
+// so standard OCI tooling can discover them.
+package referrers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/chainguard-dev/tlogistry/internal/secrets"
+	"github.com/chainguard-dev/tlogistry/internal/upstream"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/kelseyhightower/envconfig"
+)
+
+const (
+	// ArtifactType is the artifact type of published pins.
+	ArtifactType = "application/vnd.dev.tlogistry.pin.v1+json"
+
+	emptyMediaType    = "application/vnd.oci.empty.v1+json"
+	manifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+)
+
+var env struct {
+	// Repo is the companion repository that pins are published to.
+	Repo     string `envconfig:"REFERRERS_REPO"`
+	Username string `envconfig:"REFERRERS_USERNAME"`
+	// Password can be a secret reference.
+	Password string `envconfig:"REFERRERS_PASSWORD"`
+}
+
+var repo name.Repository
+
+func init() {
+	if err := envconfig.Process("", &env); err != nil {
+		log.Fatalf("envconfig: %v", err)
+	}
+	if env.Repo != "" {
+		var err error
+		if repo, err = name.NewRepository(env.Repo); err != nil {
+			log.Fatalf("parsing REFERRERS_REPO: %v", err)
+		}
+	}
+}
+
+// Enabled reports whether pins are published as referrers.
+func Enabled() bool { return env.Repo != "" }
+
+// Descriptor is an OCI content descriptor.
+type Descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+type manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Subject       *Descriptor       `json:"subject"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Publish pushes an artifact containing the pin's attestation, whose
+// subject is the pinned manifest, to the companion repository, and returns
+// the artifact's digest.
+func Publish(ctx context.Context, subject Descriptor, tag name.Tag, uuid string, attestation []byte, attestationType string) (string, error) {
+	password, err := secrets.Resolve(ctx, env.Password)
+	if err != nil {
+		return "", err
+	}
+	auth, err := upstream.Authorization(repo.RegistryStr(), repo.RepositoryStr(), "pull,push", env.Username, password)
+	if err != nil {
+		return "", fmt.Errorf("getting token: %w", err)
+	}
+	p := &pusher{auth: auth}
+
+	empty := []byte("{}")
+	if err := p.blob(ctx, empty); err != nil {
+		return "", err
+	}
+	if err := p.blob(ctx, attestation); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(manifest{
+		SchemaVersion: 2,
+		MediaType:     manifestMediaType,
+		ArtifactType:  ArtifactType,
+		Config:        Descriptor{MediaType: emptyMediaType, Digest: digest(empty), Size: int64(len(empty))},
+		Layers:        []Descriptor{{MediaType: attestationType, Digest: digest(attestation), Size: int64(len(attestation))}},
+		Subject:       &subject,
+		Annotations: map[string]string{
+			"dev.tlogistry.tag":                tag.String(),
+			"dev.tlogistry.uuid":               uuid,
+			"org.opencontainers.image.created": time.Now().UTC().Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	d := digest(b)
+	resp, err := p.do(ctx, http.MethodPut, p.url("manifests/"+d), manifestMediaType, b)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("putting manifest: unexpected status code %d", resp.StatusCode)
+	}
+	log.Printf("=== REFERRERS: published %s@%s for %s", repo, d, tag)
+	return d, nil
+}
+
+type pusher struct{ auth string }
+
+func (p *pusher) url(path string) string {
+	return fmt.Sprintf("https://%s/v2/%s/%s", repo.RegistryStr(), repo.RepositoryStr(), path)
+}
+
+func (p *pusher) do(ctx context.Context, method, url, contentType string, body []byte) (*http.Response, error) {
+	log.Println("  -->", method, url)
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if p.auth != "" {
+		req.Header.Set("Authorization", p.auth)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := upstream.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("  <--", resp.StatusCode)
+	return resp, nil
+}
+
+// blob uploads the blob, unless it's already there.
+func (p *pusher) blob(ctx context.Context, b []byte) error {
+	d := digest(b)
+	resp, err := p.do(ctx, http.MethodHead, p.url("blobs/"+d), "", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	resp, err = p.do(ctx, http.MethodPost, p.url("blobs/uploads/"), "", nil)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("starting upload: unexpected status code %d", resp.StatusCode)
+	}
+	loc, err := resp.Location()
+	if err != nil {
+		return fmt.Errorf("starting upload: %w", err)
+	}
+	q := loc.Query()
+	q.Set("digest", d)
+	loc.RawQuery = q.Encode()
+
+	resp, err = p.do(ctx, http.MethodPut, loc.String(), "application/octet-stream", b)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("uploading blob %s: unexpected status code %d", d, resp.StatusCode)
+	}
+	return nil
+}
+
+func digest(b []byte) string { return fmt.Sprintf("sha256:%x", sha256.Sum256(b)) }
@@ -0,0 +1,58 @@
+package rekor
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// maxBatchConcurrency is how many entries in a batch are added concurrently.
+const maxBatchConcurrency = 8
+
+// Pin is a tag and the digest to record for it.
+type Pin struct {
+	Tag    name.Tag
+	Digest string
+	Extra  map[string]interface{}
+}
+
+// PutBatch adds a new entry to the log for each pin.
+//
+// Each pin gets its own DSSE envelope and entry, but they're all signed
+// under one Fulcio cert. The returned infos and errors are in the same
+// order as the pins.
+func PutBatch(ctx context.Context, pins []Pin) ([]*Info, []error) {
+	infos := make([]*Info, len(pins))
+	errs := make([]error, len(pins))
+	if len(pins) == 0 {
+		return infos, errs
+	}
+
+	signer, err := getSigner(ctx)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return infos, errs
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxBatchConcurrency)
+	for i, p := range pins {
+		i, p := i, p
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := ctx.Err(); err != nil {
+				errs[i] = err
+				return
+			}
+			infos[i], errs[i] = put(ctx, signer, p.Tag, p.Digest, p.Extra)
+		}()
+	}
+	wg.Wait()
+	return infos, errs
+}
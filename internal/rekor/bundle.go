@@ -0,0 +1,170 @@
+package rekor
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/in-toto/in-toto-golang/in_toto"
+	rmodels "github.com/sigstore/rekor/pkg/generated/models"
+)
+
+// BundleMediaType is the media type of Sigstore bundles served for pins.
+const BundleMediaType = "application/vnd.dev.sigstore.bundle+json;version=0.1"
+
+// envelopes holds the signed DSSE envelopes for entries written by this
+// instance, keyed by UUID. Rekor doesn't return signatures for intoto
+// entries, so they can't be recovered from the log.
+var envelopes sync.Map
+
+// material is what's needed to verify an entry offline.
+type material struct {
+	body       []byte // canonicalized entry body.
+	logID      string
+	set        []byte // signed entry timestamp.
+	proof      *rmodels.InclusionProof
+	cert       []byte // DER-encoded signing cert.
+	payload    []byte // in-toto statement.
+	integrated int64
+	logIndex   int64
+	entryUUID  string
+}
+
+func newMaterial(uuid string, le rmodels.LogEntryAnon, body, cert, payload []byte) *material {
+	m := &material{
+		body:      body,
+		cert:      cert,
+		payload:   payload,
+		entryUUID: uuid,
+	}
+	if le.LogID != nil {
+		m.logID = *le.LogID
+	}
+	if le.IntegratedTime != nil {
+		m.integrated = *le.IntegratedTime
+	}
+	if le.LogIndex != nil {
+		m.logIndex = *le.LogIndex
+	}
+	if le.Verification != nil {
+		m.set = le.Verification.SignedEntryTimestamp
+		m.proof = le.Verification.InclusionProof
+	}
+	return m
+}
+
+// Bundle is a Sigstore bundle, in its JSON encoding.
+//
+// This mirrors the protobuf-specs bundle by hand rather than using
+// sigstore-go, which needs a newer Go than this module targets and would
+// replace the Rekor and Fulcio clients wholesale. Once the module can move to
+// it, creating and verifying entries should go through its bundle API, and
+// this type can go away.
+type Bundle struct {
+	MediaType            string               `json:"mediaType"`
+	VerificationMaterial verificationMaterial `json:"verificationMaterial"`
+	DSSEEnvelope         json.RawMessage      `json:"dsseEnvelope"`
+}
+
+type verificationMaterial struct {
+	X509CertificateChain struct {
+		Certificates []rawBytes `json:"certificates"`
+	} `json:"x509CertificateChain"`
+	TlogEntries []tlogEntry `json:"tlogEntries"`
+}
+
+type rawBytes struct {
+	RawBytes []byte `json:"rawBytes"`
+}
+
+type tlogEntry struct {
+	LogIndex string `json:"logIndex"`
+	LogID    struct {
+		KeyID []byte `json:"keyId"`
+	} `json:"logId"`
+	KindVersion struct {
+		Kind    string `json:"kind"`
+		Version string `json:"version"`
+	} `json:"kindVersion"`
+	IntegratedTime   string `json:"integratedTime"`
+	InclusionPromise *struct {
+		SignedEntryTimestamp []byte `json:"signedEntryTimestamp"`
+	} `json:"inclusionPromise,omitempty"`
+	InclusionProof    *inclusionProof `json:"inclusionProof,omitempty"`
+	CanonicalizedBody []byte          `json:"canonicalizedBody"`
+}
+
+type inclusionProof struct {
+	LogIndex string   `json:"logIndex"`
+	RootHash []byte   `json:"rootHash"`
+	TreeSize string   `json:"treeSize"`
+	Hashes   [][]byte `json:"hashes"`
+}
+
+// Bundle returns a Sigstore bundle for the entry, which can be used to verify
+// the pin without access to Rekor.
+//
+// If the entry wasn't written by this instance since it started, its DSSE
+// signature isn't known, and the bundle's envelope has no signatures. The
+// payload can still be checked against the payload hash in the entry body,
+// which is covered by the signed entry timestamp.
+func (i *Info) Bundle() (*Bundle, error) {
+	m := i.material
+	if m == nil {
+		return nil, fmt.Errorf("no verification material for entry %q", i.UUID)
+	}
+
+	b := &Bundle{MediaType: BundleMediaType}
+	b.VerificationMaterial.X509CertificateChain.Certificates = []rawBytes{{RawBytes: m.cert}}
+
+	var te tlogEntry
+	te.LogIndex = strconv.FormatInt(m.logIndex, 10)
+	logID, err := hex.DecodeString(m.logID)
+	if err != nil {
+		return nil, fmt.Errorf("decoding log ID: %w", err)
+	}
+	te.LogID.KeyID = logID
+	te.KindVersion.Kind = "intoto"
+	te.KindVersion.Version = "0.0.1"
+	te.IntegratedTime = strconv.FormatInt(m.integrated, 10)
+	if len(m.set) > 0 {
+		te.InclusionPromise = &struct {
+			SignedEntryTimestamp []byte `json:"signedEntryTimestamp"`
+		}{m.set}
+	}
+	if p := m.proof; p != nil && p.LogIndex != nil && p.RootHash != nil && p.TreeSize != nil {
+		ip := &inclusionProof{
+			LogIndex: strconv.FormatInt(*p.LogIndex, 10),
+			TreeSize: strconv.FormatInt(*p.TreeSize, 10),
+		}
+		if ip.RootHash, err = hex.DecodeString(*p.RootHash); err != nil {
+			return nil, fmt.Errorf("decoding inclusion proof root hash: %w", err)
+		}
+		for _, h := range p.Hashes {
+			hb, err := hex.DecodeString(h)
+			if err != nil {
+				return nil, fmt.Errorf("decoding inclusion proof hash: %w", err)
+			}
+			ip.Hashes = append(ip.Hashes, hb)
+		}
+		te.InclusionProof = ip
+	}
+	te.CanonicalizedBody = m.body
+	b.VerificationMaterial.TlogEntries = []tlogEntry{te}
+
+	if env, ok := envelopes.Load(m.entryUUID); ok {
+		b.DSSEEnvelope = env.([]byte)
+	} else {
+		b.DSSEEnvelope, err = json.Marshal(map[string]interface{}{
+			"payload":     m.payload,
+			"payloadType": in_toto.PayloadType,
+			"signatures":  []interface{}{},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,42 @@
+package rekor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// written caches the pins this instance has written, keyed by IndexKey.
+//
+// Fresh entries aren't searchable in Rekor's index until they're
+// integrated, so without this, pulling a tag again seconds after it was
+// first seen would pin it again.
+var written sync.Map // string -> writtenPin
+
+type writtenPin struct {
+	digest string
+	info   *Info
+	at     time.Time
+}
+
+// remember caches the pin, which has just been written.
+func remember(tag name.Tag, digest string, info *Info) {
+	written.Store(IndexKey(tag), writtenPin{digest: digest, info: info, at: time.Now()})
+	index(Canonical(tag), digest, info)
+}
+
+// recall returns the pin this instance wrote for the tag within ttl, if any.
+// A ttl of zero never expires.
+func recall(tag name.Tag, ttl time.Duration) (string, *Info, bool) {
+	v, ok := written.Load(IndexKey(tag))
+	if !ok {
+		return "", nil, false
+	}
+	p := v.(writtenPin)
+	if ttl != 0 && time.Since(p.at) > ttl {
+		written.Delete(IndexKey(tag))
+		return "", nil, false
+	}
+	return p.digest, p.info, true
+}
@@ -0,0 +1,86 @@
+package rekor
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// CanonicalVersion is the version of the canonical form that new entries are
+// written and indexed under, and is recorded in their predicates.
+//
+// Entries are indexed by the SHA-256 of the canonical form, so once entries
+// have been written under a version, its output must never change, whatever
+// go-containerregistry does. To change the form, add a new version, and
+// search for the old one in legacyForms.
+const CanonicalVersion = "v1"
+
+// dockerHubHosts are the hosts that serve Docker Hub, which are all written
+// as name.DefaultRegistry.
+var dockerHubHosts = map[string]bool{
+	"docker.io":            true,
+	"index.docker.io":      true,
+	"registry-1.docker.io": true,
+}
+
+// Canonical returns the canonical form of the tag, under CanonicalVersion.
+//
+// The v1 form is "REGISTRY/REPOSITORY:TAG", where:
+//   - REGISTRY is the registry's host, and port if any, lowercased, and
+//     index.docker.io for any of Docker Hub's hosts.
+//   - REPOSITORY is the repository's path, with library/ added to Docker
+//     Hub's official images.
+//   - TAG is the tag as given.
+//
+// So Docker Hub's shorthands, like ubuntu:22.04, library/ubuntu:22.04 and
+// docker.io/library/ubuntu:22.04, are all index.docker.io/library/ubuntu:22.04.
+func Canonical(tag name.Tag) string {
+	host := strings.ToLower(tag.RegistryStr())
+	repo := tag.RepositoryStr()
+	if dockerHubHosts[host] {
+		host = name.DefaultRegistry
+		if !strings.Contains(repo, "/") {
+			repo = "library/" + repo
+		}
+	}
+	return fmt.Sprintf("%s/%s:%s", host, repo, tag.TagStr())
+}
+
+// legacyForms returns the other forms of the tag that entries might have been
+// indexed under before CanonicalVersion: go-containerregistry's formatting
+// of the tag as it was requested, which for Docker Hub could be any of its
+// shorthands.
+func legacyForms(tag name.Tag) []string {
+	canonical := Canonical(tag)
+	seen := map[string]bool{canonical: true}
+	var out []string
+	add := func(s string) {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	add(tag.String())
+	add(tag.Name())
+	if host, _, _ := strings.Cut(canonical, "/"); host == name.DefaultRegistry {
+		repo := strings.TrimSuffix(strings.TrimPrefix(canonical, host+"/"), ":"+tag.TagStr())
+		repos := []string{repo}
+		if short := strings.TrimPrefix(repo, "library/"); short != repo {
+			repos = append(repos, short)
+		}
+		for _, host := range []string{"", "docker.io/", name.DefaultRegistry + "/"} {
+			for _, repo := range repos {
+				add(fmt.Sprintf("%s%s:%s", host, repo, tag.TagStr()))
+			}
+		}
+	}
+	return out
+}
+
+// key returns the hash under which entries for the form of a tag are indexed
+// in Rekor.
+func key(form string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(form)))
+}
@@ -0,0 +1,85 @@
+package rekor
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// TestCanonicalGolden pins the v1 canonical form and index key of tags.
+// Existing entries are indexed by these keys, so they must never change; a
+// new form needs a new CanonicalVersion.
+func TestCanonicalGolden(t *testing.T) {
+	const (
+		ubuntu  = "9c5323a6196b3488dfb9a0974e2beb5122127ae6200dc3d979a45c3b364bd468"
+		grafana = "2a4e8697cbdd4e68fd957f5fb16fc29d159268ba3d621bc35cc6a518d13001fb"
+		app     = "5c064a33b6ff42be100e63e82f2356b5bcd0232904f583ee45acea2ce5f3985c"
+		local   = "ee5a8f9657d6c547e65e15befe07a3bb8457464609d37492c612aa1930ea0a8f"
+	)
+	if CanonicalVersion != "v1" {
+		t.Fatalf("CanonicalVersion = %q, add golden tests for it", CanonicalVersion)
+	}
+	for _, c := range []struct {
+		tag, want, key string
+	}{
+		{"ubuntu:22.04", "index.docker.io/library/ubuntu:22.04", ubuntu},
+		{"library/ubuntu:22.04", "index.docker.io/library/ubuntu:22.04", ubuntu},
+		{"docker.io/library/ubuntu:22.04", "index.docker.io/library/ubuntu:22.04", ubuntu},
+		{"docker.io/ubuntu:22.04", "index.docker.io/library/ubuntu:22.04", ubuntu},
+		{"index.docker.io/library/ubuntu:22.04", "index.docker.io/library/ubuntu:22.04", ubuntu},
+		{"registry-1.docker.io/library/ubuntu:22.04", "index.docker.io/library/ubuntu:22.04", ubuntu},
+		{"registry-1.docker.io/ubuntu:22.04", "index.docker.io/library/ubuntu:22.04", ubuntu},
+		{"docker.io/grafana/grafana:9.0.0", "index.docker.io/grafana/grafana:9.0.0", grafana},
+		{"grafana/grafana:9.0.0", "index.docker.io/grafana/grafana:9.0.0", grafana},
+		{"ghcr.io/example/app:v1", "ghcr.io/example/app:v1", app},
+		{"GHCR.io/example/app:v1", "ghcr.io/example/app:v1", app},
+		{"localhost:5000/app:latest", "localhost:5000/app:latest", local},
+	} {
+		tag, err := name.NewTag(c.tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := Canonical(tag); got != c.want {
+			t.Errorf("Canonical(%q) = %q, want %q", c.tag, got, c.want)
+		}
+		if got := IndexKey(tag); got != c.key {
+			t.Errorf("IndexKey(%q) = %q, want %q", c.tag, got, c.key)
+		}
+	}
+}
+
+func TestLegacyForms(t *testing.T) {
+	for _, c := range []struct {
+		tag  string
+		want []string
+	}{{
+		tag: "ubuntu:22.04",
+		want: []string{
+			"ubuntu:22.04",
+			"library/ubuntu:22.04",
+			"docker.io/library/ubuntu:22.04",
+			"docker.io/ubuntu:22.04",
+			"index.docker.io/ubuntu:22.04",
+		},
+	}, {
+		tag: "docker.io/grafana/grafana:9.0.0",
+		want: []string{
+			"docker.io/grafana/grafana:9.0.0",
+			"grafana/grafana:9.0.0",
+		},
+	}, {
+		tag:  "GHCR.io/example/app:v1",
+		want: []string{"GHCR.io/example/app:v1"},
+	}, {
+		tag: "ghcr.io/example/app:v1",
+	}} {
+		tag, err := name.NewTag(c.tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := legacyForms(tag); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("legacyForms(%q) = %q, want %q", c.tag, got, c.want)
+		}
+	}
+}
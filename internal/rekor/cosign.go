@@ -0,0 +1,219 @@
+package rekor
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sigstore/rekor/pkg/generated/client/pubkey"
+	"github.com/sigstore/sigstore/pkg/fulcioroots"
+)
+
+// Signature summarizes a verified keyless cosign signature.
+type Signature struct {
+	Identity string `json:"identity"`
+	Issuer   string `json:"issuer"`
+	LogIndex int64  `json:"logIndex"`
+}
+
+// cosignBundle is the Rekor bundle cosign attaches to signatures.
+type cosignBundle struct {
+	SignedEntryTimestamp []byte
+	Payload              struct {
+		Body           string `json:"body"`
+		IntegratedTime int64  `json:"integratedTime"`
+		LogIndex       int64  `json:"logIndex"`
+		LogID          string `json:"logID"`
+	}
+}
+
+// VerifyCosign verifies a keyless cosign signature of the manifest digest,
+// given the signature layer's payload and its signature, certificate, chain
+// and bundle annotations.
+//
+// The signature's cert must chain to Fulcio at the time its Rekor bundle
+// says it was integrated, and the bundle must be signed by Rekor and record
+// this signature.
+func VerifyCosign(digest string, payload []byte, sig, certPEM, chainPEM, bundle string) (*Signature, error) {
+	var simple struct {
+		Critical struct {
+			Image struct {
+				Digest string `json:"docker-manifest-digest"`
+			} `json:"image"`
+		} `json:"critical"`
+	}
+	if err := json.Unmarshal(payload, &simple); err != nil {
+		return nil, fmt.Errorf("decoding payload: %w", err)
+	}
+	if simple.Critical.Image.Digest != digest {
+		return nil, fmt.Errorf("payload is for %q, not %q", simple.Critical.Image.Digest, digest)
+	}
+	if certPEM == "" {
+		return nil, errors.New("not a keyless signature")
+	}
+	if bundle == "" {
+		return nil, errors.New("no Rekor bundle")
+	}
+
+	var b cosignBundle
+	if err := json.Unmarshal([]byte(bundle), &b); err != nil {
+		return nil, fmt.Errorf("decoding bundle: %w", err)
+	}
+	if err := verifySET(b); err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, errors.New("decoding cert: no PEM block")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing cert: %w", err)
+	}
+	roots, err := fulcioroots.Get()
+	if err != nil {
+		return nil, fmt.Errorf("getting Fulcio root cert: %w", err)
+	}
+	intermediates, err := fulcioroots.GetIntermediates()
+	if err != nil {
+		return nil, fmt.Errorf("getting Fulcio intermedate certs: %w", err)
+	}
+	for rest := []byte(chainPEM); ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if c, err := x509.ParseCertificate(block.Bytes); err == nil {
+			intermediates.AddCert(c)
+		}
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   time.Unix(b.Payload.IntegratedTime, 0),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return nil, fmt.Errorf("cert is not from Fulcio: %w", err)
+	}
+
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported public key type %T", cert.PublicKey)
+	}
+	rawSig, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return nil, fmt.Errorf("decoding signature: %w", err)
+	}
+	h := sha256.Sum256(payload)
+	if !ecdsa.VerifyASN1(pub, h[:], rawSig) {
+		return nil, errors.New("invalid signature")
+	}
+
+	// The bundle's entry has to be for this signature, or it proves nothing.
+	body, err := base64.StdEncoding.DecodeString(b.Payload.Body)
+	if err != nil {
+		return nil, fmt.Errorf("decoding bundle body: %w", err)
+	}
+	var entry struct {
+		Spec struct {
+			Data struct {
+				Hash struct {
+					Value string `json:"value"`
+				} `json:"hash"`
+			} `json:"data"`
+			Signature struct {
+				Content string `json:"content"`
+			} `json:"signature"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return nil, fmt.Errorf("decoding bundle body: %w", err)
+	}
+	if entry.Spec.Data.Hash.Value != hex.EncodeToString(h[:]) || entry.Spec.Signature.Content != sig {
+		return nil, errors.New("bundle is for a different signature")
+	}
+
+	id, err := certIdentity(cert)
+	if err != nil {
+		return nil, err
+	}
+	return &Signature{
+		Identity: id,
+		Issuer:   certIssuer(cert),
+		LogIndex: b.Payload.LogIndex,
+	}, nil
+}
+
+var rekorKey struct {
+	mu  sync.Mutex
+	pub *ecdsa.PublicKey
+}
+
+// rekorPublicKey returns Rekor's public key, which signs entry timestamps.
+func rekorPublicKey() (*ecdsa.PublicKey, error) {
+	rekorKey.mu.Lock()
+	defer rekorKey.mu.Unlock()
+	if rekorKey.pub != nil {
+		return rekorKey.pub, nil
+	}
+	params := pubkey.NewGetPublicKeyParams()
+	params.SetTimeout(env.RekorTimeout)
+	resp, err := rekorClient.Pubkey.GetPublicKey(params)
+	if err != nil {
+		return nil, fmt.Errorf("getting Rekor public key: %w", err)
+	}
+	block, _ := pem.Decode([]byte(resp.Payload))
+	if block == nil {
+		return nil, errors.New("decoding Rekor public key: no PEM block")
+	}
+	k, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing Rekor public key: %w", err)
+	}
+	pub, ok := k.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported Rekor public key type %T", k)
+	}
+	rekorKey.pub = pub
+	return pub, nil
+}
+
+// verifySET checks that the bundle's signed entry timestamp is from Rekor.
+func verifySET(b cosignBundle) error {
+	pub, err := rekorPublicKey()
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	if id := sha256.Sum256(der); hex.EncodeToString(id[:]) != b.Payload.LogID {
+		return fmt.Errorf("bundle is from another log %q", b.Payload.LogID)
+	}
+	// Maps are marshaled with sorted keys, which is the canonical form Rekor
+	// signs for these values.
+	canonical, err := json.Marshal(map[string]interface{}{
+		"body":           b.Payload.Body,
+		"integratedTime": b.Payload.IntegratedTime,
+		"logIndex":       b.Payload.LogIndex,
+		"logID":          b.Payload.LogID,
+	})
+	if err != nil {
+		return err
+	}
+	h := sha256.Sum256(canonical)
+	if !ecdsa.VerifyASN1(pub, h[:], b.SignedEntryTimestamp) {
+		return errors.New("invalid signed entry timestamp")
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package rekor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyCosignRejects(t *testing.T) {
+	const digest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	payload := `{"critical":{"identity":{"docker-reference":"example.com/app"},"image":{"docker-manifest-digest":"` + digest + `"},"type":"cosign container image signature"}}`
+	for _, c := range []struct {
+		desc            string
+		payload         string
+		cert, bundle    string
+		wantErrContains string
+	}{{
+		desc:            "not json",
+		payload:         "nope",
+		wantErrContains: "decoding payload",
+	}, {
+		desc:            "other digest",
+		payload:         strings.Replace(payload, digest, "sha256:1111111111111111111111111111111111111111111111111111111111111111", 1),
+		wantErrContains: "payload is for",
+	}, {
+		desc:            "keyed",
+		payload:         payload,
+		wantErrContains: "not a keyless signature",
+	}, {
+		desc:            "no bundle",
+		payload:         payload,
+		cert:            "-----BEGIN CERTIFICATE-----",
+		wantErrContains: "no Rekor bundle",
+	}} {
+		t.Run(c.desc, func(t *testing.T) {
+			_, err := VerifyCosign(digest, []byte(c.payload), "", c.cert, "", c.bundle)
+			if err == nil || !strings.Contains(err.Error(), c.wantErrContains) {
+				t.Errorf("VerifyCosign: got err %v, want it to contain %q", err, c.wantErrContains)
+			}
+		})
+	}
+}
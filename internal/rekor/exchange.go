@@ -0,0 +1,99 @@
+package rekor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strings"
+)
+
+// exchangeProvider exchanges the ID token in IDENTITY_TOKEN_FILE for one
+// Fulcio accepts using an OAuth 2.0 token exchange (RFC 8693), like GCP
+// workload identity federation, for deployments whose own tokens aren't
+// accepted by Fulcio, like on-prem Kubernetes.
+//
+// If TOKEN_EXCHANGE_SERVICE_ACCOUNT is set, the exchanged token is a GCP
+// access token used to get an ID token for that service account. Otherwise,
+// the exchange is asked for an ID token directly.
+type exchangeProvider struct{}
+
+const (
+	tokenTypeJWT         = "urn:ietf:params:oauth:token-type:jwt"
+	tokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+	tokenTypeIDToken     = "urn:ietf:params:oauth:token-type:id_token"
+)
+
+func (exchangeProvider) detect(context.Context) bool { return env.TokenExchangeURL != "" }
+
+func (exchangeProvider) idtoken(ctx context.Context, audience string) (string, error) {
+	subject, err := fileProvider{}.idtoken(ctx, audience)
+	if err != nil {
+		return "", err
+	}
+
+	form := neturl.Values{
+		"grant_type":         {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"subject_token":      {subject},
+		"subject_token_type": {tokenTypeJWT},
+		"audience":           {env.TokenExchangeAudience},
+	}
+	if env.TokenExchangeServiceAccount != "" {
+		form.Set("requested_token_type", tokenTypeAccessToken)
+		form.Set("scope", "https://www.googleapis.com/auth/cloud-platform")
+	} else {
+		form.Set("requested_token_type", tokenTypeIDToken)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, env.TokenExchangeURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var exchanged struct {
+		// The issued token is returned as access_token, whatever its type.
+		AccessToken string `json:"access_token"`
+	}
+	if err := doJSON(req, &exchanged); err != nil {
+		return "", fmt.Errorf("exchanging token: %w", err)
+	}
+	if env.TokenExchangeServiceAccount == "" {
+		return exchanged.AccessToken, nil
+	}
+
+	// Impersonate the service account to get an ID token.
+	body, err := json.Marshal(map[string]interface{}{"audience": audience, "includeEmail": true})
+	if err != nil {
+		return "", err
+	}
+	url := fmt.Sprintf("https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateIdToken", neturl.PathEscape(env.TokenExchangeServiceAccount))
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+exchanged.AccessToken)
+	var generated struct {
+		Token string `json:"token"`
+	}
+	if err := doJSON(req, &generated); err != nil {
+		return "", fmt.Errorf("generating ID token for %s: %w", env.TokenExchangeServiceAccount, err)
+	}
+	return generated.Token, nil
+}
+
+// doJSON sends the request, and decodes the JSON response into v.
+func doJSON(req *http.Request, v interface{}) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("unexpected status code (%s): %d: %s", req.URL.Redacted(), resp.StatusCode, b)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
@@ -0,0 +1,42 @@
+package rekor
+
+import (
+	"sync"
+	"time"
+)
+
+// Health summarizes the outcomes of recent calls to Rekor.
+type Health struct {
+	LastSuccess time.Time     `json:"lastSuccess"`
+	LastFailure time.Time     `json:"lastFailure"`
+	LastError   string        `json:"lastError,omitempty"`
+	LastLatency time.Duration `json:"lastLatency"`
+}
+
+// Healthy reports whether the most recent call to Rekor succeeded.
+func (h Health) Healthy() bool { return !h.LastSuccess.Before(h.LastFailure) }
+
+var (
+	healthMu sync.Mutex
+	health   Health
+)
+
+// CurrentHealth returns the health of Rekor, as observed by this instance.
+func CurrentHealth() Health {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	return health
+}
+
+// observe records the outcome of a call to Rekor that started at start.
+func observe(start time.Time, err error) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	health.LastLatency = time.Since(start)
+	if err != nil {
+		health.LastFailure = time.Now()
+		health.LastError = err.Error()
+	} else {
+		health.LastSuccess = time.Now()
+	}
+}
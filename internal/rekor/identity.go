@@ -0,0 +1,79 @@
+package rekor
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// trusted reports whether entries signed with certs for the identity are
+// trusted.
+//
+// If IDENTITIES is set, those identities (emails or URIs, like SPIFFE IDs)
+// are trusted. Otherwise, only the instance's service account email is.
+func trusted(identity string) bool {
+	if len(env.Identities) == 0 {
+		return identity == email()
+	}
+	for _, id := range env.Identities {
+		if id == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// Identity returns the identity that signs (and is trusted to sign) entries.
+func Identity() string {
+	if len(env.Identities) > 0 {
+		return env.Identities[0]
+	}
+	return email()
+}
+
+// certIdentity returns the single identity a Fulcio cert was issued for:
+// either an email address or a URI (e.g., a SPIFFE ID).
+func certIdentity(cert *x509.Certificate) (string, error) {
+	var ids []string
+	ids = append(ids, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	if len(ids) != 1 {
+		return "", fmt.Errorf("saw unexpected number of associated identities: %v", ids)
+	}
+	return ids[0], nil
+}
+
+// tokenSubject returns the identity the ID token asserts, which Fulcio
+// requires proof of possession for: its email claim if it has one,
+// otherwise its subject.
+//
+// The token isn't verified; Fulcio does that.
+func tokenSubject(idtoken string) (string, error) {
+	parts := strings.Split(idtoken, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed ID token")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("decoding ID token claims: %w", err)
+	}
+	var claims struct {
+		Email string `json:"email"`
+		Sub   string `json:"sub"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return "", fmt.Errorf("decoding ID token claims: %w", err)
+	}
+	if claims.Email != "" {
+		return claims.Email, nil
+	}
+	if claims.Sub == "" {
+		return "", errors.New("ID token has no email or subject")
+	}
+	return claims.Sub, nil
+}
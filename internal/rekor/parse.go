@@ -0,0 +1,86 @@
+package rekor
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+const (
+	// statementType is the in-toto statement type of attestations written by tlogistry.
+	statementType = "intoto"
+	// predicateType identifies attestations written by tlogistry.
+	predicateType = "tlogistry-fetched"
+)
+
+// attestation is the in-toto statement recorded for a pin.
+type attestation struct {
+	Type          string `json:"_type"`
+	PredicateType string `json:"predicateType"`
+	Subject       []struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+	Predicate struct {
+		Digest string `json:"digest"`
+		Tag    string `json:"tag"`
+	}
+}
+
+// parseAttestation parses a Rekor entry's attestation data.
+//
+// Entries are untrusted: anybody can write entries to Rekor under the same
+// index keys.
+func parseAttestation(data []byte) (*attestation, error) {
+	var att attestation
+	if err := json.Unmarshal(data, &att); err != nil {
+		return nil, fmt.Errorf("json-decoding Rekor LogEntry attestation data: %w", err)
+	}
+	return &att, nil
+}
+
+// decodeBody decodes a Rekor entry's base64-encoded body.
+func decodeBody(body interface{}) ([]byte, error) {
+	s, ok := body.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected Rekor LogEntry body type %T", body)
+	}
+	leb, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("decoding Rekor LogEntry body: %w", err)
+	}
+	return leb, nil
+}
+
+// bodyPublicKey returns the PEM-encoded public key (or cert) recorded in a
+// Rekor entry's decoded body.
+func bodyPublicKey(leb []byte) ([]byte, error) {
+	var ent struct {
+		Spec struct {
+			PublicKey []byte
+		}
+	}
+	if err := json.Unmarshal(leb, &ent); err != nil {
+		return nil, fmt.Errorf("unmarshaling Rekor LogEntry body: %w", err)
+	}
+	return ent.Spec.PublicKey, nil
+}
+
+// parseCert parses the PEM-encoded certificate.
+func parseCert(b []byte) (*x509.Certificate, error) {
+	if len(b) == 0 {
+		return nil, errors.New("public key is missing")
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+	return cert, nil
+}
@@ -0,0 +1,99 @@
+package rekor
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func testCertPEM(t testing.TB) []byte {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: "test"},
+		NotBefore:      time.Now(),
+		NotAfter:       time.Now().Add(time.Hour),
+		EmailAddresses: []string{"test@example.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func FuzzParseAttestation(f *testing.F) {
+	f.Add([]byte(`{"predicateType":"tlogistry-fetched","predicate":{"tag":"ubuntu:latest","digest":"sha256:abcd"}}`))
+	f.Add([]byte(`{"predicateType":1}`))
+	f.Add([]byte(`null`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		att, err := parseAttestation(data)
+		if err == nil && att == nil {
+			t.Fatal("parseAttestation returned nil attestation and nil error")
+		}
+	})
+}
+
+func FuzzDecodeBody(f *testing.F) {
+	f.Add(base64.StdEncoding.EncodeToString([]byte(`{"spec":{"publicKey":"LS0t"}}`)))
+	f.Add("not base64!")
+	f.Fuzz(func(t *testing.T, body string) {
+		leb, err := decodeBody(body)
+		if err != nil {
+			return
+		}
+		if _, err := bodyPublicKey(leb); err != nil {
+			return
+		}
+	})
+}
+
+func FuzzBodyPublicKey(f *testing.F) {
+	certPEM := testCertPEM(f)
+	body, err := json.Marshal(map[string]interface{}{"spec": map[string]interface{}{"publicKey": certPEM}})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(body)
+	f.Add([]byte(`{"spec":{"publicKey":12}}`))
+	f.Add([]byte(`{"spec":null}`))
+	f.Fuzz(func(t *testing.T, leb []byte) {
+		pub, err := bodyPublicKey(leb)
+		if err != nil {
+			return
+		}
+		_, _ = parseCert(pub)
+	})
+}
+
+func FuzzParseCert(f *testing.F) {
+	f.Add(testCertPEM(f))
+	f.Add([]byte("-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		cert, err := parseCert(b)
+		if err == nil && cert == nil {
+			t.Fatal("parseCert returned nil cert and nil error")
+		}
+	})
+}
+
+func TestDecodeBodyNotString(t *testing.T) {
+	if _, err := decodeBody(map[string]interface{}{}); err == nil {
+		t.Error("decodeBody(map): got nil error")
+	}
+	if _, err := decodeBody(nil); err == nil {
+		t.Error("decodeBody(nil): got nil error")
+	}
+}
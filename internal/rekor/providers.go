@@ -0,0 +1,211 @@
+package rekor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// provider gets ID tokens for the instance's identity to exchange for
+// Fulcio certs.
+type provider interface {
+	// detect reports whether the instance is running in this environment.
+	detect(ctx context.Context) bool
+	idtoken(ctx context.Context, audience string) (string, error)
+}
+
+// providers are the identity providers, in the order they're detected.
+var providers = []struct {
+	name string
+	provider
+}{
+	{"exchange", exchangeProvider{}},
+	{"file", fileProvider{}},
+	{"gcp", gcpProvider{}},
+	{"aws", awsProvider{}},
+	{"azure", azureProvider{}},
+}
+
+var metadataClient = &http.Client{Timeout: 5 * time.Second}
+
+var detected struct {
+	once sync.Once
+	name string
+	provider
+}
+
+// identityProvider returns the configured identity provider, or detects it.
+func identityProvider(ctx context.Context) (string, provider) {
+	detected.once.Do(func() {
+		for _, p := range providers {
+			if env.IdentityProvider == p.name || env.IdentityProvider == "" && p.detect(ctx) {
+				detected.name, detected.provider = p.name, p.provider
+				log.Println("using identity provider", p.name)
+				return
+			}
+		}
+		if env.IdentityProvider != "" {
+			log.Fatalf("unknown IDENTITY_PROVIDER %q", env.IdentityProvider)
+		}
+		log.Fatal("couldn't detect an identity provider; set IDENTITY_PROVIDER")
+	})
+	return detected.name, detected.provider
+}
+
+func idtoken(ctx context.Context) (string, error) {
+	_, p := identityProvider(ctx)
+	return p.idtoken(ctx, env.Audience)
+}
+
+var internalEmail string
+var emailOnce sync.Once
+
+// email returns the instance's GCP service account email, which is the
+// identity trusted by default.
+func email() string {
+	emailOnce.Do(func() {
+		if name, _ := identityProvider(context.Background()); name != "gcp" {
+			log.Fatalf("IDENTITIES must be set when using the %s identity provider", name)
+		}
+		email, err := getMetadata("http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/email")
+		if err != nil {
+			log.Fatalf("failed to get email: %v", err)
+		}
+		log.Println("Hello, my name is", email)
+		internalEmail = email
+	})
+	return internalEmail
+}
+
+func getMetadata(url string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	all, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code: %d: %s", resp.StatusCode, string(all))
+	}
+	return string(all), nil
+}
+
+// gcpProvider gets ID tokens for the service account from the GCE metadata
+// server.
+type gcpProvider struct{}
+
+func (gcpProvider) detect(ctx context.Context) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://metadata.google.internal", nil)
+	if err != nil {
+		return false
+	}
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.Header.Get("Metadata-Flavor") == "Google"
+}
+
+func (gcpProvider) idtoken(_ context.Context, audience string) (string, error) {
+	return getMetadata("http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/identity?audience=" + neturl.QueryEscape(audience))
+}
+
+// fileProvider reads ID tokens from IDENTITY_TOKEN_FILE, e.g., a projected
+// Kubernetes service account token with the sigstore audience on EKS or
+// AKS.
+type fileProvider struct{}
+
+func (fileProvider) detect(context.Context) bool {
+	if env.IdentityTokenFile == "" {
+		return false
+	}
+	_, err := os.Stat(env.IdentityTokenFile)
+	return err == nil
+}
+
+func (fileProvider) idtoken(context.Context, string) (string, error) {
+	if env.IdentityTokenFile == "" {
+		return "", errors.New("IDENTITY_TOKEN_FILE isn't set")
+	}
+	b, err := os.ReadFile(env.IdentityTokenFile)
+	if err != nil {
+		return "", fmt.Errorf("reading ID token: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// awsProvider detects EC2, ECS and EKS with IMDSv2.
+//
+// IMDS doesn't issue OIDC ID tokens, so they're read from IDENTITY_TOKEN_FILE,
+// e.g., a projected service account token on EKS.
+type awsProvider struct{}
+
+func (awsProvider) detect(ctx context.Context) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, "http://169.254.169.254/latest/api/token", nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+func (awsProvider) idtoken(ctx context.Context, audience string) (string, error) {
+	if env.IdentityTokenFile == "" {
+		return "", errors.New("on AWS, IDENTITY_TOKEN_FILE must be set to a file containing an ID token, like a projected service account token")
+	}
+	return fileProvider{}.idtoken(ctx, audience)
+}
+
+// azureProvider gets tokens for the managed identity from Azure IMDS.
+type azureProvider struct{}
+
+func (azureProvider) detect(ctx context.Context) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://169.254.169.254/metadata/instance?api-version=2021-02-01", nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Metadata", "true")
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+func (azureProvider) idtoken(ctx context.Context, audience string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource="+neturl.QueryEscape(audience), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+	var tok struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := doJSON(req, &tok); err != nil {
+		return "", fmt.Errorf("getting managed identity token: %w", err)
+	}
+	return tok.AccessToken, nil
+}
@@ -0,0 +1,75 @@
+package rekor
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/chainguard-dev/tlogistry/internal/metrics"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// queueSize is how many writes can be waiting in the queue.
+const queueSize = 1000
+
+var mQueued = metrics.NewGauge("tlogistry_rekor_queued_writes", "Entries waiting to be written to Rekor in the background.")
+
+type queuedPut struct {
+	tag    name.Tag
+	digest string
+	extra  map[string]interface{}
+	done   func(*Info, error)
+}
+
+var queue struct {
+	once    sync.Once
+	ch      chan queuedPut
+	pending sync.Map // IndexKey -> struct{}
+}
+
+// PutAsync queues a new entry to be written to the log in the background,
+// and calls done with the result. It returns false if the entry couldn't be
+// queued, because the queue is full.
+//
+// If an entry for the tag is already queued, it isn't queued again, and
+// done isn't called.
+func PutAsync(tag name.Tag, digest string, extra map[string]interface{}, done func(*Info, error)) bool {
+	queue.once.Do(func() {
+		queue.ch = make(chan queuedPut, queueSize)
+		go drain()
+	})
+	key := IndexKey(tag)
+	if _, dup := queue.pending.LoadOrStore(key, struct{}{}); dup {
+		return true
+	}
+	select {
+	case queue.ch <- queuedPut{tag: tag, digest: digest, extra: extra, done: done}:
+		mQueued.Add(1)
+		return true
+	default:
+		queue.pending.Delete(key)
+		return false
+	}
+}
+
+func drain() {
+	for p := range queue.ch {
+		mQueued.Add(-1)
+		ctx, cancel := context.WithTimeout(context.Background(), env.RekorTimeout)
+		info, err := Put(ctx, p.tag, p.digest, p.extra)
+		cancel()
+		queue.pending.Delete(IndexKey(p.tag))
+		if err != nil {
+			log.Println("!!! ERROR WRITING QUEUED ENTRY TO REKOR:", err)
+		}
+		if p.done != nil {
+			p.done(info, err)
+		}
+	}
+}
+
+// Queued reports whether an entry for the tag is waiting to be written.
+func Queued(tag name.Tag) bool {
+	_, ok := queue.pending.Load(IndexKey(tag))
+	return ok
+}
@@ -4,22 +4,17 @@ import (
 	"bytes"
 	"context"
 	"crypto"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
-	"crypto/sha256"
 	"crypto/x509"
-	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	neturl "net/url"
-	"sync"
+	"path"
 	"time"
 
+	"github.com/chainguard-dev/tlogistry/internal/digests"
 	"github.com/go-openapi/strfmt"
 	"github.com/go-openapi/swag"
 	"github.com/google/go-containerregistry/pkg/name"
@@ -45,12 +40,41 @@ var env struct {
 	FulcioURL     string        `envconfig:"FULCIO_URL" default:"https://fulcio.sigstore.dev"`
 	FulcioTimeout time.Duration `envconfig:"FULCIO_TIMEOUT" default:"1m"`
 	RekorTimeout  time.Duration `envconfig:"REKOR_TIMEOUT" default:"1m"`
+	// Issuer is the OIDC issuer that must have issued the identity token
+	// for which our Fulcio certs were issued.
+	Issuer string `envconfig:"OIDC_ISSUER" default:"https://accounts.google.com"`
+	// Identities, if set, are the identities whose entries are trusted,
+	// instead of the instance's service account email.
+	Identities []string `envconfig:"IDENTITIES"`
+	// IdentityProvider is where ID tokens come from: exchange, file, gcp,
+	// aws or azure. If it's not set, it's detected.
+	IdentityProvider string `envconfig:"IDENTITY_PROVIDER"`
+	// IdentityTokenFile is a file containing an ID token, like a projected
+	// Kubernetes service account token, which is reread for each use.
+	IdentityTokenFile string `envconfig:"IDENTITY_TOKEN_FILE"`
+	// TokenExchangeURL is an OAuth 2.0 token exchange endpoint, like
+	// https://sts.googleapis.com/v1/token, that the token in
+	// IdentityTokenFile is exchanged at for one Fulcio accepts.
+	TokenExchangeURL            string `envconfig:"TOKEN_EXCHANGE_URL"`
+	TokenExchangeAudience       string `envconfig:"TOKEN_EXCHANGE_AUDIENCE"`
+	TokenExchangeServiceAccount string `envconfig:"TOKEN_EXCHANGE_SERVICE_ACCOUNT"`
+	// RekorAPI is the version of the Rekor API to use, v1 or v2.
+	RekorAPI string `envconfig:"REKOR_API" default:"v1"`
+	// PendingTTL is how long pins this instance wrote are trusted before
+	// they're found in Rekor's index.
+	PendingTTL time.Duration `envconfig:"REKOR_PENDING_TTL" default:"10m"`
+	// RekorV2Key is the PEM-encoded public key of the Rekor v2 log, which
+	// must have signed its checkpoints.
+	RekorV2Key string `envconfig:"REKOR_V2_KEY"`
 }
 
 func init() {
 	if err := envconfig.Process("", &env); err != nil {
 		log.Fatalf("envconfig: %v", err)
 	}
+	if env.RekorAPI != "v1" && env.RekorAPI != "v2" {
+		log.Fatalf("REKOR_API must be v1 or v2, got %q", env.RekorAPI)
+	}
 
 	var err error
 	rekorClient, err = rekor.GetRekorClient(env.RekorURL)
@@ -64,44 +88,12 @@ func init() {
 	fulcioClient = fapi.NewClient(fulcioServer)
 }
 
-var internalEmail string
-var emailOnce sync.Once
-
-func email() string {
-	emailOnce.Do(func() {
-		email, err := getMetadata("http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/email")
-		if err != nil {
-			log.Fatalf("failed to get email: %v", err)
-		}
-		log.Println("Hello, my name is", email)
-		internalEmail = email
-	})
-	return internalEmail
-}
-
-func getMetadata(url string) (string, error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return "", err
-	}
-	req.Header.Set("Metadata-Flavor", "Google")
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-	all, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("unexpected status code: %d: %s", resp.StatusCode, string(all))
-	}
-	return string(all), nil
-}
+// URL returns the URL of the Rekor server.
+func URL() string { return env.RekorURL }
 
-func idtoken(ctx context.Context) (idtoken string, err error) {
-	return getMetadata("http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/identity?audience=" + env.Audience)
+// IndexKey returns the hash under which entries for the tag are indexed in Rekor.
+func IndexKey(tag name.Tag) string {
+	return key(Canonical(tag))
 }
 
 // Info represents information found in Rekor about the tag.
@@ -109,59 +101,68 @@ type Info struct {
 	UUID           string
 	LogIndex       int64
 	IntegratedTime time.Time
+	// Identity is the identity of the cert that signed the entry.
+	Identity string
+
+	material *material // See Bundle.
 }
 
 // Put adds a new entry to the log.
-func Put(ctx context.Context, tag name.Tag, digest string) (*Info, error) {
-	idtoken, err := idtoken(ctx)
+//
+// Any extra fields are recorded in the attestation's predicate alongside the
+// tag and digest.
+func Put(ctx context.Context, tag name.Tag, digest string, extra map[string]interface{}) (*Info, error) {
+	signer, err := getSigner(ctx)
 	if err != nil {
 		return nil, err
 	}
+	return put(ctx, signer, tag, digest, extra)
+}
 
-	// Get signing cert from ephemeral private key and idtoken.
-	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		return nil, fmt.Errorf("generating ephemeral private key: %w", err)
-	}
-	pubBytes, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
-	if err != nil {
-		return nil, fmt.Errorf("marshaling public key: %w", err)
-	}
-	h := sha256.Sum256([]byte(email()))
-	proof, err := ecdsa.SignASN1(rand.Reader, priv, h[:])
-	if err != nil {
-		return nil, fmt.Errorf("signing identity with private key: %w", err)
-	}
-	fresp, err := fulcioClient.SigningCert(fapi.CertificateRequest{
-		PublicKey: fapi.Key{
-			Algorithm: "ecdsa",
-			Content:   pubBytes,
-		},
-		SignedEmailAddress: proof,
-	}, idtoken)
+// put adds a new entry to the log, signed by the signer, and remembers it
+// until it can be found in the log.
+func put(ctx context.Context, signer *signer, tag name.Tag, digest string, extra map[string]interface{}) (*Info, error) {
+	info, err := create(ctx, signer, tag, digest, extra)
 	if err != nil {
-		return nil, fmt.Errorf("getting signing cert: %w", err)
+		return nil, err
 	}
+	remember(tag, digest, info)
+	return info, nil
+}
 
+// create adds a new entry to the log, signed by the signer.
+func create(ctx context.Context, signer *signer, tag name.Tag, digest string, extra map[string]interface{}) (*Info, error) {
 	// Sign the message.
+	predicate := map[string]interface{}{}
+	for k, v := range extra {
+		predicate[k] = v
+	}
+	predicate["tag"] = Canonical(tag)
+	predicate["canonicalization"] = CanonicalVersion
+	predicate["digest"] = digest
+	subjects := []in_toto.Subject{{
+		Name:   Canonical(tag),
+		Digest: map[string]string{"sha256": IndexKey(tag)},
+	}}
+	if alg, hex, err := digests.Parse(digest); err == nil {
+		// Also index the entry by the digest, for WhoHas.
+		subjects = append(subjects, in_toto.Subject{
+			Name:   digest,
+			Digest: map[string]string{alg: hex},
+		})
+	}
 	msg, err := json.Marshal(in_toto.Statement{
 		StatementHeader: in_toto.StatementHeader{
-			Type:          "intoto",
-			PredicateType: "tlogistry-fetched",
-			Subject: []in_toto.Subject{{
-				Name:   tag.String(),
-				Digest: map[string]string{"sha256": fmt.Sprintf("%x", sha256.Sum256([]byte(tag.String())))},
-			}},
-		},
-		Predicate: map[string]string{
-			"tag":    tag.String(),
-			"digest": digest,
+			Type:          statementType,
+			PredicateType: predicateType,
+			Subject:       subjects,
 		},
+		Predicate: predicate,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("encoding message: %w", err)
 	}
-	s, err := signature.LoadECDSASigner(priv, crypto.SHA256)
+	s, err := signature.LoadECDSASigner(signer.priv, crypto.SHA256)
 	if err != nil {
 		return nil, fmt.Errorf("loading signer: %w", err)
 	}
@@ -170,10 +171,15 @@ func Put(ctx context.Context, tag name.Tag, digest string) (*Info, error) {
 		return nil, fmt.Errorf("signing message: %w", err)
 	}
 
+	if env.RekorAPI == "v2" {
+		return putV2(ctx, signer, signed)
+	}
+
 	// Record tag + digest, with ephemeral Fulcio cert as private key.
-	certPEMBase64 := strfmt.Base64(fresp.CertPEM)
+	certPEMBase64 := strfmt.Base64(signer.certPEM)
 	params := rentries.NewCreateLogEntryParams()
 	params.SetTimeout(env.FulcioTimeout)
+	params.SetContext(ctx)
 	params.SetProposedEntry(&rmodels.Intoto{
 		APIVersion: swag.String("0.0.1"),
 		Spec: rmodels.IntotoV001Schema{
@@ -183,32 +189,117 @@ func Put(ctx context.Context, tag name.Tag, digest string) (*Info, error) {
 			PublicKey: &certPEMBase64,
 		},
 	})
+	start := time.Now()
 	created, err := rekorClient.Entries.CreateLogEntry(params)
-	if err != nil {
+	var conflict *rentries.CreateLogEntryConflict
+	if errors.As(err, &conflict) {
+		observe(start, nil) // Rekor is working fine.
+	} else {
+		observe(start, err)
+	}
+	var uuid string
+	var le rmodels.LogEntryAnon
+	switch {
+	case conflict != nil:
+		// The entry already exists, e.g., because a retried request was
+		// integrated after all, so use that one.
+		uuid = conflict.ETag
+		if loc := conflict.Location.String(); loc != "" {
+			uuid = path.Base(loc)
+		}
+		if uuid == "" || uuid == "." || uuid == "/" {
+			return nil, fmt.Errorf("adding Rekor entry: conflict with unknown existing entry: %w", err)
+		}
+		log.Println("---- Rekor entry already exists:", uuid)
+		if le, err = adopt(ctx, tag, digest, uuid); err != nil {
+			return nil, fmt.Errorf("adopting existing Rekor entry %q: %w", uuid, err)
+		}
+	case err != nil:
 		return nil, fmt.Errorf("adding Rekor entry: %w", err)
+	default:
+		uuid = created.ETag
+		le = created.Payload[uuid]
+		log.Println("---- Rekor entry created!")
 	}
-
-	le := created.Payload[created.ETag]
-	log.Println("---- Rekor entry created!")
-	log.Println("- UUID:", created.ETag)
+	if le.IntegratedTime == nil || le.LogIndex == nil {
+		return nil, fmt.Errorf("Rekor entry %q is missing its integrated time or log index", uuid)
+	}
+	log.Println("- UUID:", uuid)
 	log.Println("- Integrated Time:", time.Unix(*le.IntegratedTime, 0).Format(time.RFC3339))
 	log.Println("- Log Index:", *le.LogIndex)
-	leb, err := base64.StdEncoding.DecodeString(le.Body.(string))
+	leb, err := decodeBody(le.Body)
 	if err != nil {
-		return nil, fmt.Errorf("decoding Rekor LogEntry body: %w", err)
+		return nil, err
 	}
 	log.Println("- Entry:", string(leb))
+	envelopes.Store(uuid, signed)
+	var certDER []byte
+	if block, _ := pem.Decode(signer.certPEM); block != nil {
+		certDER = block.Bytes
+	}
 	return &Info{
-		UUID:           created.ETag,
+		UUID:           uuid,
 		LogIndex:       *le.LogIndex,
 		IntegratedTime: time.Unix(*le.IntegratedTime, 0),
+		Identity:       signer.identity,
+		material:       newMaterial(uuid, le, leb, certDER, msg),
 	}, nil
 }
 
+// adopt gets the existing entry with the UUID, and checks that it's a valid
+// pin of the tag to the digest.
+func adopt(ctx context.Context, tag name.Tag, digest, uuid string) (rmodels.LogEntryAnon, error) {
+	le, err := getEntry(ctx, uuid)
+	if err != nil {
+		return le, err
+	}
+	roots, err := fulcioroots.Get()
+	if err != nil {
+		return le, fmt.Errorf("getting Fulcio root cert: %w", err)
+	}
+	intermediates, err := fulcioroots.GetIntermediates()
+	if err != nil {
+		return le, fmt.Errorf("getting Fulcio intermedate certs: %w", err)
+	}
+	var got string
+	if err := guard(uuid, func() (err error) {
+		got, _, err = verifyEntry(Canonical(tag), uuid, le, roots, intermediates)
+		return err
+	}); err != nil {
+		return le, err
+	}
+	if got != digest {
+		return le, fmt.Errorf("existing entry pins %q, want %q", got, digest)
+	}
+	return le, nil
+}
+
+// getEntry gets the entry with the UUID from Rekor.
+func getEntry(ctx context.Context, uuid string) (rmodels.LogEntryAnon, error) {
+	params := rentries.NewGetLogEntryByUUIDParams()
+	params.SetTimeout(env.RekorTimeout)
+	params.SetContext(ctx)
+	params.SetEntryUUID(uuid)
+	resp, err := rekorClient.Entries.GetLogEntryByUUID(params)
+	if err != nil {
+		return rmodels.LogEntryAnon{}, err
+	}
+	if len(resp.Payload) == 1 {
+		for _, le := range resp.Payload {
+			return le, nil
+		}
+	}
+	return rmodels.LogEntryAnon{}, fmt.Errorf("unexpected payloads: %v", resp.Payload)
+}
+
 // Get searches Rekor for entries associated with the given tag, and
 // returns all digests attested to by those entries, signed by a Fulcio cert
 // associated with our identity.
 func Get(ctx context.Context, tag name.Tag) (string, *Info, error) {
+	if env.RekorAPI == "v2" {
+		return getV2(tag)
+	}
+
 	// Get Fulcio root cert.
 	fulcioRoot, err := fulcioroots.Get()
 	if err != nil {
@@ -219,136 +310,84 @@ func Get(ctx context.Context, tag name.Tag) (string, *Info, error) {
 		return "", nil, fmt.Errorf("getting Fulcio intermedate certs: %w", err)
 	}
 
+	found, err := search(ctx, Canonical(tag), fulcioRoot, fulcioIntermediates)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(found) == 0 {
+		// Our own entry might not be searchable yet.
+		if digest, info, ok := recall(tag, env.PendingTTL); ok {
+			log.Println("entry for", tag, "is pending integration:", info.UUID)
+			return digest, info, nil
+		}
+		// The tag might have been pinned under a legacy form.
+		for _, form := range legacyForms(tag) {
+			if found, err = search(ctx, form, fulcioRoot, fulcioIntermediates); err != nil {
+				return "", nil, err
+			}
+			if len(found) > 0 {
+				log.Printf("found entries for %s under %q", tag, form)
+				break
+			}
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		log.Println("no matching Rekor entries found for", tag)
+		return "", nil, nil // No entries found for tag.
+	case 1:
+		for d, info := range found {
+			return d, info, nil
+		}
+	}
+	return "", nil, fmt.Errorf("multiple digests found for %s: %v", tag, found)
+}
+
+// search returns the digests attested to by verified entries for the
+// form of a tag, with the entries that attest to them.
+func search(ctx context.Context, form string, roots, intermediates *x509.CertPool) (map[string]*Info, error) {
 	// Find entries for digest of fully qualified tagged image ref.
 	iparams := rindex.NewSearchIndexParams()
 	iparams.SetTimeout(env.RekorTimeout)
-	iparams.SetQuery(&rmodels.SearchIndex{Hash: fmt.Sprintf("%x", sha256.Sum256([]byte(tag.String())))}) // Search by the digest of the tag.
+	iparams.SetContext(ctx)
+	iparams.SetQuery(&rmodels.SearchIndex{Hash: key(form)}) // Search by the digest of the tag.
+	start := time.Now()
 	iresp, err := rekorClient.Index.SearchIndex(iparams)
+	observe(start, err)
 	if err != nil {
-		return "", nil, fmt.Errorf("querying Rekor entries: %w", err)
+		return nil, fmt.Errorf("querying Rekor entries: %w", err)
 	}
-	if len(iresp.Payload) == 0 {
-		return "", nil, nil // Never seen this image:tag before.
+	if len(iresp.Payload) > maxEntries {
+		log.Printf("found %d entries for %s, only checking the first %d", len(iresp.Payload), form, maxEntries)
+		iresp.Payload = iresp.Payload[:maxEntries]
 	}
 	found := map[string]*Info{} // unique digests from verified attestations.
 	for _, e := range iresp.Payload {
 		log.Println("- matched found Rekor entry:", e)
-		gparams := rentries.NewGetLogEntryByUUIDParams()
-		gparams.SetTimeout(env.RekorTimeout)
-		gparams.SetEntryUUID(e)
-		gresp, err := rekorClient.Entries.GetLogEntryByUUID(gparams)
+		le, err := getEntry(ctx, e)
 		if err != nil {
 			log.Printf("error getting Rekor entry: %v", err)
 			continue
 		}
 
-		var le rmodels.LogEntryAnon
-		if len(gresp.Payload) != 1 {
-			log.Println("unexpected payloads:", gresp.Payload)
-			continue
-		}
-		for _, v := range gresp.Payload {
-			le = v
-			break
-		}
-		if le.Body == nil {
-			log.Println("No body for entry:", e)
-			continue
-		}
-
-		var att struct {
-			PredicateType string `json:"predicateType"`
-			Predicate     struct {
-				Digest string `json:"digest"`
-				Tag    string `json:"tag"`
-			}
-		}
-		if err := json.Unmarshal(le.Attestation.Data, &att); err != nil {
-			log.Printf("json-decoding Rekor LogEntry attestation data: %v", err)
-			continue
-		}
-		if att.PredicateType != "tlogistry-fetched" {
-			log.Printf("Rekor LogEntry attestation predicateType %q not supported", att.PredicateType)
-			continue
-		}
-		if att.Predicate.Tag != tag.String() {
-			log.Printf("Rekor LogEntry predicate tag mismatch: got %q, want %q", att.Predicate.Tag, tag.String())
-			continue // How did this even happen.
-		}
-		// Okay, we found an attestation for the tag in Rekor. Let's make sure it was put there by us.
-
-		leb, err := base64.StdEncoding.DecodeString(le.Body.(string))
-		if err != nil {
-			return "", nil, fmt.Errorf("decoding Rekor LogEntry body: %w", err)
-		}
-		var ent struct {
-			Spec struct {
-				PublicKey []byte
-			}
-		}
-		if err := json.Unmarshal(leb, &ent); err != nil {
-			return "", nil, fmt.Errorf("unmarshaling Rekor LogEntry body: %w", err)
-		}
-
-		if len(ent.Spec.PublicKey) == 0 {
-			log.Printf("public key is missing")
-			continue
-		}
-		block, _ := pem.Decode(ent.Spec.PublicKey)
-		if block == nil {
-			log.Printf("decoding %q: no PEM block found", e)
-			continue
-		}
-		cert, err := x509.ParseCertificate(block.Bytes)
-		if err != nil {
-			log.Printf("decoding %q: parsing certificate: %v", e, err)
-			continue
-		}
-
-		// Verify cert is from Fulcio.
-		if _, err := cert.Verify(x509.VerifyOptions{
-			// THIS IS IMPORTANT: WE DO NOT CHECK TIMES HERE
-			// THE CERTIFICATE IS TREATED AS TRUSTED FOREVER
-			// WE CHECK THAT THE SIGNATURES WERE CREATED DURING THIS WINDOW
-			CurrentTime:   cert.NotBefore,
-			Roots:         fulcioRoot,
-			Intermediates: fulcioIntermediates,
-			KeyUsages: []x509.ExtKeyUsage{
-				x509.ExtKeyUsageCodeSigning,
-			},
+		var digest string
+		var info *Info
+		if err := guard(e, func() (err error) {
+			digest, info, err = verifyEntry(form, e, le, roots, intermediates)
+			return err
 		}); err != nil {
-			log.Printf("decoding %q: cert is not from Fulcio: %v", e, err)
-			continue
-		}
-
-		if len(cert.EmailAddresses) != 1 {
-			log.Printf("decoding %q: saw unexpected number of associated identities: %v", e, cert.EmailAddresses)
-			continue
-		}
-
-		if cert.EmailAddresses[0] != email() {
-			log.Printf("decoding %q: saw unexpected associated identity: %v", e, cert.EmailAddresses[0])
-			// Ignore entries not recorded by us.
-			// Don't log this since it may be spammy and doesn't matter.
+			var rej *rejection
+			if errors.As(err, &rej) {
+				mRejected.Inc(rej.reason)
+			}
+			log.Printf("decoding %q: %v", e, err)
 			continue
 		}
 
 		log.Printf("found matching Rekor entry: %q", e)
-		found[att.Predicate.Digest] = &Info{
-			UUID:           e,
-			LogIndex:       *le.LogIndex,
-			IntegratedTime: time.Unix(*le.IntegratedTime, 0),
-		}
+		found[digest] = info
+		index(form, digest, info)
 	}
-
-	switch len(found) {
-	case 0:
-		log.Println("no matching Rekor entries found for", tag)
-		return "", nil, nil // No entries found for tag.
-	case 1:
-		for d, info := range found {
-			return d, info, nil
-		}
-	}
-	return "", nil, fmt.Errorf("multiple digests found for %s: %v", tag, found)
+	return found, nil
 }
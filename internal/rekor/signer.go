@@ -0,0 +1,115 @@
+package rekor
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	fapi "github.com/sigstore/fulcio/pkg/api"
+)
+
+// certExpiryMargin is how long before a cached cert expires that it stops
+// being used, so that entries are integrated while the cert is valid.
+const certExpiryMargin = 2 * time.Minute
+
+// signer is an ephemeral private key, and the Fulcio cert issued for it.
+type signer struct {
+	priv     *ecdsa.PrivateKey
+	certPEM  []byte
+	notAfter time.Time
+	identity string
+}
+
+var signers struct {
+	mu     sync.Mutex
+	cached *signer
+}
+
+// getSigner returns the cached signer if its cert is still valid, or gets a
+// cert for a new ephemeral key.
+//
+// Fulcio certs are only valid for ~10 minutes, but bursts of first-seen tags
+// can share one, saving a Fulcio round trip and key generation for each.
+// Pins that arrive while a cert is being issued wait for it, rather than
+// each getting their own.
+func getSigner(ctx context.Context) (*signer, error) {
+	signers.mu.Lock()
+	defer signers.mu.Unlock()
+	if s := signers.cached; s != nil && time.Now().Add(certExpiryMargin).Before(s.notAfter) {
+		return s, nil
+	}
+	signers.cached = nil
+
+	s, err := newSigner(ctx)
+	if err != nil {
+		return nil, err
+	}
+	signers.cached = s
+	return s, nil
+}
+
+// newSigner gets a signing cert from a new ephemeral private key and an
+// ID token.
+func newSigner(ctx context.Context) (*signer, error) {
+	idtoken, err := idtoken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating ephemeral private key: %w", err)
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling public key: %w", err)
+	}
+	subject, err := tokenSubject(idtoken)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256([]byte(subject))
+	proof, err := ecdsa.SignASN1(rand.Reader, priv, h[:])
+	if err != nil {
+		return nil, fmt.Errorf("signing identity with private key: %w", err)
+	}
+	fresp, err := fulcioClient.SigningCert(fapi.CertificateRequest{
+		PublicKey: fapi.Key{
+			Algorithm: "ecdsa",
+			Content:   pubBytes,
+		},
+		SignedEmailAddress: proof,
+	}, idtoken)
+	if err != nil {
+		return nil, fmt.Errorf("getting signing cert: %w", err)
+	}
+
+	block, _ := pem.Decode(fresp.CertPEM)
+	if block == nil {
+		return nil, errors.New("decoding signing cert: no PEM block")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing signing cert: %w", err)
+	}
+	log.Println("got Fulcio cert valid until", cert.NotAfter.Format(time.RFC3339))
+	id, err := certIdentity(cert)
+	if err != nil {
+		return nil, fmt.Errorf("signing cert: %w", err)
+	}
+	return &signer{
+		priv:     priv,
+		certPEM:  fresp.CertPEM,
+		notAfter: cert.NotAfter,
+		identity: id,
+	}, nil
+}
@@ -0,0 +1,71 @@
+package rekor
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+)
+
+// maxIndexedDigests is the most digests kept in the local index.
+const maxIndexedDigests = 10000
+
+// byDigest is the local index of the pins this instance has written or
+// verified, by the digest they pin. It covers pins that aren't searchable in
+// Rekor yet, and keeps answering when Rekor can't.
+var byDigest = struct {
+	sync.Mutex
+	pins  map[string]map[string]TagPin // digest -> UUID -> pin
+	order []string                     // digests, oldest first, for eviction
+}{pins: map[string]map[string]TagPin{}}
+
+// index adds the pin of the tag form to the digest to the local index.
+func index(form, digest string, info *Info) {
+	if info == nil {
+		return
+	}
+	byDigest.Lock()
+	defer byDigest.Unlock()
+	pins, ok := byDigest.pins[digest]
+	if !ok {
+		if len(byDigest.order) == maxIndexedDigests {
+			delete(byDigest.pins, byDigest.order[0])
+			byDigest.order = byDigest.order[1:]
+		}
+		pins = map[string]TagPin{}
+		byDigest.pins[digest] = pins
+		byDigest.order = append(byDigest.order, digest)
+	}
+	pins[info.UUID] = TagPin{Tag: form, Info: info}
+}
+
+// TagsForDigest returns every pin of a tag to the digest, oldest first, from
+// the local index and Rekor. If Rekor can't be searched, only the local
+// index's pins are returned, and partial is true.
+func TagsForDigest(ctx context.Context, digest string) (pins []TagPin, partial bool, err error) {
+	found := map[string]TagPin{}
+	byDigest.Lock()
+	for uuid, p := range byDigest.pins[digest] {
+		found[uuid] = p
+	}
+	byDigest.Unlock()
+
+	remote, err := WhoHas(ctx, digest)
+	switch {
+	case err != nil && len(found) == 0:
+		return nil, false, err
+	case err != nil:
+		log.Printf("!!! ERROR SEARCHING REKOR FOR %s, USING LOCAL INDEX: %v", digest, err)
+		partial = true
+	}
+	for _, p := range remote {
+		found[p.UUID] = p
+		index(p.Tag, digest, p.Info)
+	}
+
+	for _, p := range found {
+		pins = append(pins, p)
+	}
+	sort.Slice(pins, func(i, j int) bool { return pins[i].LogIndex < pins[j].LogIndex })
+	return pins, partial, nil
+}
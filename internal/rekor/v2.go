@@ -0,0 +1,269 @@
+package rekor
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// Rekor v2 is a tile-based log, which has no search index: entries can only
+// be found by log index. Pins recorded in it are only found in the cache of
+// pins this instance has written.
+//
+// https://github.com/sigstore/rekor-tiles
+
+var v2Client = &http.Client{}
+
+// v2Entry is a TransparencyLogEntry, in its protobuf JSON encoding.
+type v2Entry struct {
+	LogIndex       string `json:"logIndex"`
+	IntegratedTime string `json:"integratedTime"`
+	InclusionProof *struct {
+		LogIndex   string   `json:"logIndex"`
+		RootHash   []byte   `json:"rootHash"`
+		TreeSize   string   `json:"treeSize"`
+		Hashes     [][]byte `json:"hashes"`
+		Checkpoint struct {
+			Envelope string `json:"envelope"`
+		} `json:"checkpoint"`
+	} `json:"inclusionProof"`
+	CanonicalizedBody []byte `json:"canonicalizedBody"`
+}
+
+// putV2 records the signed DSSE envelope in a Rekor v2 log, and verifies the
+// new entry's inclusion in the log's checkpoint.
+func putV2(ctx context.Context, signer *signer, signed []byte) (*Info, error) {
+	block, _ := pem.Decode(signer.certPEM)
+	if block == nil {
+		return nil, errors.New("decoding signing cert: no PEM block")
+	}
+	req, err := json.Marshal(map[string]interface{}{
+		"dsseRequestV002": map[string]interface{}{
+			"envelope": json.RawMessage(signed),
+			"verifiers": []interface{}{map[string]interface{}{
+				"x509Certificate": map[string]interface{}{"rawBytes": block.Bytes},
+				"keyDetails":      "PKIX_ECDSA_P256_SHA_256",
+			}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encoding entry: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, env.RekorTimeout)
+	defer cancel()
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(env.RekorURL, "/")+"/api/v2/log/entries", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	start := time.Now()
+	resp, err := v2Client.Do(hreq)
+	if err == nil && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		resp.Body.Close()
+		err = fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, b)
+	}
+	observe(start, err)
+	if err != nil {
+		return nil, fmt.Errorf("adding Rekor entry: %w", err)
+	}
+	defer resp.Body.Close()
+	var e v2Entry
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxBodySize)).Decode(&e); err != nil {
+		return nil, fmt.Errorf("decoding Rekor entry: %w", err)
+	}
+	if err := e.verify(); err != nil {
+		return nil, fmt.Errorf("verifying Rekor entry: %w", err)
+	}
+
+	leaf := leafHash(e.CanonicalizedBody)
+	logIndex, _ := strconv.ParseInt(e.LogIndex, 10, 64)
+	integrated := time.Now()
+	if t, _ := strconv.ParseInt(e.IntegratedTime, 10, 64); t != 0 {
+		integrated = time.Unix(t, 0)
+	}
+	info := &Info{
+		UUID:           hex.EncodeToString(leaf[:]),
+		LogIndex:       logIndex,
+		IntegratedTime: integrated,
+		Identity:       signer.identity,
+	}
+	log.Println("---- Rekor v2 entry created!")
+	log.Println("- Entry hash:", info.UUID)
+	log.Println("- Log Index:", info.LogIndex)
+	return info, nil
+}
+
+// getV2 returns the digest pinned for the tag by this instance, if any.
+func getV2(tag name.Tag) (string, *Info, error) {
+	digest, info, _ := recall(tag, 0)
+	return digest, info, nil
+}
+
+// verify checks the entry's inclusion proof against its checkpoint, and the
+// checkpoint's signature if the log's key is configured.
+func (e *v2Entry) verify() error {
+	p := e.InclusionProof
+	if p == nil {
+		return errors.New("no inclusion proof")
+	}
+	index, err := strconv.ParseInt(p.LogIndex, 10, 64)
+	if err != nil {
+		return fmt.Errorf("parsing log index: %w", err)
+	}
+	size, err := strconv.ParseInt(p.TreeSize, 10, 64)
+	if err != nil {
+		return fmt.Errorf("parsing tree size: %w", err)
+	}
+	cp, err := parseCheckpoint(p.Checkpoint.Envelope)
+	if err != nil {
+		return err
+	}
+	if cp.size != size || !bytes.Equal(cp.root, p.RootHash) {
+		return errors.New("inclusion proof doesn't match checkpoint")
+	}
+	if err := verifyInclusion(index, size, leafHash(e.CanonicalizedBody), p.Hashes, p.RootHash); err != nil {
+		return err
+	}
+	if env.RekorV2Key == "" {
+		return nil
+	}
+	return cp.verify(env.RekorV2Key)
+}
+
+// checkpoint is a signed note committing to the log's tree.
+//
+// https://github.com/transparency-dev/formats/blob/main/log/README.md
+type checkpoint struct {
+	text []byte // the signed text, up to and including its final newline.
+	size int64
+	root []byte
+	sigs [][]byte // signatures, without their key hash prefix.
+}
+
+func parseCheckpoint(note string) (*checkpoint, error) {
+	i := strings.Index(note, "\n\n")
+	if i < 0 {
+		return nil, errors.New("malformed checkpoint: no signatures")
+	}
+	cp := &checkpoint{text: []byte(note[:i+1])}
+	lines := strings.Split(note[:i], "\n")
+	if len(lines) < 3 {
+		return nil, errors.New("malformed checkpoint: too few lines")
+	}
+	var err error
+	if cp.size, err = strconv.ParseInt(lines[1], 10, 64); err != nil {
+		return nil, fmt.Errorf("malformed checkpoint size: %w", err)
+	}
+	if cp.root, err = base64.StdEncoding.DecodeString(lines[2]); err != nil {
+		return nil, fmt.Errorf("malformed checkpoint root hash: %w", err)
+	}
+	for _, l := range strings.Split(strings.TrimSuffix(note[i+2:], "\n"), "\n") {
+		// — <name> <base64(key hash || signature)>
+		f := strings.Fields(l)
+		if len(f) != 3 || f[0] != "—" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(f[2])
+		if err != nil || len(b) <= 4 {
+			continue
+		}
+		cp.sigs = append(cp.sigs, b[4:])
+	}
+	return cp, nil
+}
+
+// verify checks that some signature on the checkpoint is from the PEM-encoded
+// public key.
+func (cp *checkpoint) verify(keyPEM string) error {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return errors.New("decoding Rekor v2 key: no PEM block")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("parsing Rekor v2 key: %w", err)
+	}
+	for _, sig := range cp.sigs {
+		switch k := pub.(type) {
+		case ed25519.PublicKey:
+			if ed25519.Verify(k, cp.text, sig) {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			h := crypto.SHA256.New()
+			h.Write(cp.text)
+			if ecdsa.VerifyASN1(k, h.Sum(nil), sig) {
+				return nil
+			}
+		default:
+			return fmt.Errorf("unsupported Rekor v2 key type %T", pub)
+		}
+	}
+	return errors.New("checkpoint isn't signed by the log")
+}
+
+// leafHash is the RFC 6962 hash of a log leaf.
+func leafHash(leaf []byte) [sha256.Size]byte {
+	return sha256.Sum256(append([]byte{0}, leaf...))
+}
+
+func nodeHash(l, r []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(l)
+	h.Write(r)
+	return h.Sum(nil)
+}
+
+// verifyInclusion checks the RFC 6962 inclusion proof of the leaf at index in
+// a tree of size with the root hash.
+func verifyInclusion(index, size int64, leaf [sha256.Size]byte, proof [][]byte, root []byte) error {
+	if index < 0 || index >= size {
+		return fmt.Errorf("log index %d out of range for tree size %d", index, size)
+	}
+	fn, sn := index, size-1
+	r := leaf[:]
+	for _, p := range proof {
+		if sn == 0 {
+			return errors.New("inclusion proof too long")
+		}
+		if fn%2 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn%2 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return errors.New("inclusion proof too short")
+	}
+	if !bytes.Equal(r, root) {
+		return errors.New("inclusion proof doesn't match root hash")
+	}
+	return nil
+}
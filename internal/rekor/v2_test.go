@@ -0,0 +1,117 @@
+package rekor
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"testing"
+)
+
+// mth is the RFC 6962 Merkle tree hash of the leaves.
+func mth(leaves [][]byte) []byte {
+	if len(leaves) == 1 {
+		h := leafHash(leaves[0])
+		return h[:]
+	}
+	k := 1
+	for k*2 < len(leaves) {
+		k *= 2
+	}
+	return nodeHash(mth(leaves[:k]), mth(leaves[k:]))
+}
+
+// auditPath is the RFC 6962 audit path for the leaf at index m.
+func auditPath(m int, leaves [][]byte) [][]byte {
+	if len(leaves) == 1 {
+		return nil
+	}
+	k := 1
+	for k*2 < len(leaves) {
+		k *= 2
+	}
+	if m < k {
+		return append(auditPath(m, leaves[:k]), mth(leaves[k:]))
+	}
+	return append(auditPath(m-k, leaves[k:]), mth(leaves[:k]))
+}
+
+func TestVerifyInclusion(t *testing.T) {
+	var leaves [][]byte
+	for i := 0; i < 9; i++ {
+		leaves = append(leaves, []byte(fmt.Sprintf("leaf %d", i)))
+	}
+	for size := 1; size <= len(leaves); size++ {
+		tree := leaves[:size]
+		root := mth(tree)
+		for i := range tree {
+			proof := auditPath(i, tree)
+			if err := verifyInclusion(int64(i), int64(size), leafHash(tree[i]), proof, root); err != nil {
+				t.Errorf("size %d, index %d: %v", size, i, err)
+			}
+			if err := verifyInclusion(int64(i), int64(size), leafHash([]byte("other")), proof, root); err == nil {
+				t.Errorf("size %d, index %d: verified the wrong leaf", size, i)
+			}
+			if len(proof) > 0 {
+				if err := verifyInclusion(int64(i), int64(size), leafHash(tree[i]), proof[1:], root); err == nil {
+					t.Errorf("size %d, index %d: verified a truncated proof", size, i)
+				}
+			}
+		}
+		if err := verifyInclusion(int64(size), int64(size), leafHash(tree[0]), nil, root); err == nil {
+			t.Errorf("size %d: verified an out of range index", size)
+		}
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	root := sha256.Sum256([]byte("root"))
+	text := fmt.Sprintf("log.example.com\n42\n%s\n", base64.StdEncoding.EncodeToString(root[:]))
+	h := sha256.Sum256([]byte(text))
+	sig, err := ecdsa.SignASN1(rand.Reader, priv, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	note := fmt.Sprintf("%s\n— log.example.com %s\n", text, base64.StdEncoding.EncodeToString(append([]byte{1, 2, 3, 4}, sig...)))
+
+	cp, err := parseCheckpoint(note)
+	if err != nil {
+		t.Fatalf("parseCheckpoint: %v", err)
+	}
+	if cp.size != 42 || string(cp.root) != string(root[:]) {
+		t.Errorf("parseCheckpoint: got size %d, root %x", cp.size, cp.root)
+	}
+	if err := cp.verify(keyPEM); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err = x509.MarshalPKIXPublicKey(&other.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.verify(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))); err == nil {
+		t.Error("verify: checkpoint verified with the wrong key")
+	}
+
+	if _, err := parseCheckpoint("log.example.com\n42\n"); err == nil {
+		t.Error("parseCheckpoint: parsed an unsigned checkpoint")
+	}
+}
@@ -0,0 +1,190 @@
+package rekor
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/chainguard-dev/tlogistry/internal/digests"
+	"github.com/chainguard-dev/tlogistry/internal/metrics"
+	rmodels "github.com/sigstore/rekor/pkg/generated/models"
+)
+
+const (
+	// maxAttestationSize is the largest attestation we'll parse. Ours are
+	// well under 1KB.
+	maxAttestationSize = 64 << 10
+	// maxBodySize is the largest base64-encoded entry body we'll parse. Ours
+	// are a few KB, mostly the cert.
+	maxBodySize = 64 << 10
+	// maxEntries is the most entries examined for a single tag.
+	maxEntries = 1000
+)
+
+var (
+	mParsePanics = metrics.NewCounter("tlogistry_rekor_entry_panics_total",
+		"Panics recovered while parsing Rekor entries.")
+	mRejected = metrics.NewCounter("tlogistry_rekor_entries_rejected_total",
+		"Rekor entries found for a tag that were rejected, by reason.", "reason")
+)
+
+// rejection is an error describing why an entry was rejected.
+type rejection struct {
+	reason string // short, for metrics.
+	err    error
+}
+
+func (r *rejection) Error() string { return fmt.Sprintf("%s: %v", r.reason, r.err) }
+func (r *rejection) Unwrap() error { return r.err }
+
+func reject(reason string, err error) error { return &rejection{reason: reason, err: err} }
+
+// guard runs f, converting any panic into an error, since entries in Rekor
+// are written by anybody and we can't trust them not to trip up the parser.
+func guard(uuid string, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			mParsePanics.Inc()
+			log.Printf("!!! PANIC PARSING REKOR ENTRY %q: %v\n%s", uuid, r, debug.Stack())
+			err = reject("panic", fmt.Errorf("%v", r))
+		}
+	}()
+	return f()
+}
+
+var (
+	// oidIssuer is Fulcio's OIDC issuer extension, whose value is the raw
+	// issuer URL.
+	oidIssuer = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	// oidIssuerV2 is Fulcio's newer OIDC issuer extension, whose value is a
+	// DER-encoded UTF8String.
+	oidIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// certIssuer returns the OIDC issuer recorded in the Fulcio cert, or "" if
+// there isn't one.
+func certIssuer(cert *x509.Certificate) string {
+	var v1 string
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidIssuerV2):
+			var s string
+			if rest, err := asn1.Unmarshal(ext.Value, &s); err == nil && len(rest) == 0 {
+				return s
+			}
+		case ext.Id.Equal(oidIssuer):
+			v1 = string(ext.Value)
+		}
+	}
+	return v1
+}
+
+// validate checks the attestation has the shape of one written by Put for
+// the form of a tag.
+func (a *attestation) validate(form string) error {
+	switch {
+	case a.Type != statementType:
+		return fmt.Errorf("unexpected statement type %q", a.Type)
+	case a.PredicateType != predicateType:
+		return fmt.Errorf("predicateType %q not supported", a.PredicateType)
+	case len(a.Subject) != 1 && len(a.Subject) != 2:
+		return fmt.Errorf("got %d subjects, want 1 or 2", len(a.Subject))
+	case a.Subject[0].Name != form || a.Subject[0].Digest["sha256"] != key(form):
+		return fmt.Errorf("subject mismatch: got %q", a.Subject[0].Name)
+	case a.Predicate.Tag != form:
+		return fmt.Errorf("predicate tag mismatch: got %q, want %q", a.Predicate.Tag, form)
+	}
+	alg, hex, err := digests.Parse(a.Predicate.Digest)
+	if err != nil {
+		return fmt.Errorf("invalid predicate digest: %w", err)
+	}
+	// Newer entries are also indexed by the digest they pin.
+	if len(a.Subject) == 2 {
+		if s := a.Subject[1]; s.Name != a.Predicate.Digest || len(s.Digest) != 1 || s.Digest[alg] != hex {
+			return fmt.Errorf("digest subject mismatch: got %q", s.Name)
+		}
+	}
+	return nil
+}
+
+// verifyEntry checks that the entry is an attestation for the form of a
+// tag, signed by a Fulcio cert for our identity, and returns the digest it
+// attests to.
+func verifyEntry(form string, uuid string, le rmodels.LogEntryAnon, roots, intermediates *x509.CertPool) (string, *Info, error) {
+	if le.Body == nil {
+		return "", nil, reject("no_body", errors.New("no body"))
+	}
+	if le.LogIndex == nil || le.IntegratedTime == nil {
+		return "", nil, reject("malformed", errors.New("missing log index or integrated time"))
+	}
+	if le.Attestation == nil {
+		return "", nil, reject("no_attestation", errors.New("no attestation"))
+	}
+	if len(le.Attestation.Data) > maxAttestationSize {
+		return "", nil, reject("too_large", fmt.Errorf("attestation is %d bytes", len(le.Attestation.Data)))
+	}
+	att, err := parseAttestation(le.Attestation.Data)
+	if err != nil {
+		return "", nil, reject("malformed", err)
+	}
+	if err := att.validate(form); err != nil {
+		return "", nil, reject("invalid_attestation", err)
+	}
+	// Okay, we found an attestation for the tag in Rekor. Let's make sure it was put there by us.
+
+	if s, ok := le.Body.(string); ok && len(s) > maxBodySize {
+		return "", nil, reject("too_large", fmt.Errorf("body is %d bytes", len(s)))
+	}
+	leb, err := decodeBody(le.Body)
+	if err != nil {
+		return "", nil, reject("malformed", err)
+	}
+	pub, err := bodyPublicKey(leb)
+	if err != nil {
+		return "", nil, reject("malformed", err)
+	}
+	cert, err := parseCert(pub)
+	if err != nil {
+		return "", nil, reject("malformed", err)
+	}
+
+	// Verify cert is from Fulcio.
+	if _, err := cert.Verify(x509.VerifyOptions{
+		// THIS IS IMPORTANT: WE DO NOT CHECK TIMES HERE
+		// THE CERTIFICATE IS TREATED AS TRUSTED FOREVER
+		// WE CHECK THAT THE SIGNATURES WERE CREATED DURING THIS WINDOW
+		CurrentTime:   cert.NotBefore,
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageCodeSigning,
+		},
+	}); err != nil {
+		return "", nil, reject("untrusted_cert", fmt.Errorf("cert is not from Fulcio: %w", err))
+	}
+
+	id, err := certIdentity(cert)
+	if err != nil {
+		return "", nil, reject("wrong_identity", err)
+	}
+	if !trusted(id) {
+		// Ignore entries not recorded by us.
+		return "", nil, reject("wrong_identity", fmt.Errorf("saw unexpected associated identity: %v", id))
+	}
+	// The same identity could be certified via a different identity provider.
+	if iss := certIssuer(cert); iss != env.Issuer {
+		return "", nil, reject("wrong_issuer", fmt.Errorf("saw unexpected OIDC issuer %q, want %q", iss, env.Issuer))
+	}
+
+	return att.Predicate.Digest, &Info{
+		UUID:           uuid,
+		LogIndex:       *le.LogIndex,
+		IntegratedTime: time.Unix(*le.IntegratedTime, 0),
+		Identity:       id,
+		material:       newMaterial(uuid, le, leb, cert.Raw, le.Attestation.Data),
+	}, nil
+}
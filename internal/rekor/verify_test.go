@@ -0,0 +1,269 @@
+package rekor
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-openapi/swag"
+	"github.com/google/go-containerregistry/pkg/name"
+	rmodels "github.com/sigstore/rekor/pkg/generated/models"
+)
+
+func TestVerifyEntryAdversarial(t *testing.T) {
+	tag, err := name.NewTag("example.com/foo:bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := "sha256:" + strings.Repeat("a", 64)
+
+	attest := func(modify func(map[string]interface{})) []byte {
+		m := map[string]interface{}{
+			"_type":         statementType,
+			"predicateType": predicateType,
+			"subject": []interface{}{map[string]interface{}{
+				"name":   tag.String(),
+				"digest": map[string]string{"sha256": IndexKey(tag)},
+			}},
+			"predicate": map[string]interface{}{
+				"tag":    tag.String(),
+				"digest": digest,
+			},
+		}
+		if modify != nil {
+			modify(m)
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	body := func(pub []byte) string {
+		b, err := json.Marshal(map[string]interface{}{"spec": map[string]interface{}{"publicKey": pub}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	entry := func(data []byte, body interface{}) rmodels.LogEntryAnon {
+		return rmodels.LogEntryAnon{
+			Attestation:    &rmodels.LogEntryAnonAttestation{Data: data},
+			Body:           body,
+			IntegratedTime: swag.Int64(1),
+			LogIndex:       swag.Int64(1),
+		}
+	}
+	certPEM := testCertPEM(t)
+
+	for _, c := range []struct {
+		desc       string
+		le         rmodels.LogEntryAnon
+		wantReason string
+	}{{
+		desc:       "no body",
+		le:         entry(attest(nil), nil),
+		wantReason: "no_body",
+	}, {
+		desc: "no log index",
+		le: func() rmodels.LogEntryAnon {
+			le := entry(attest(nil), body(certPEM))
+			le.LogIndex = nil
+			return le
+		}(),
+		wantReason: "malformed",
+	}, {
+		desc: "no attestation",
+		le: func() rmodels.LogEntryAnon {
+			le := entry(nil, body(certPEM))
+			le.Attestation = nil
+			return le
+		}(),
+		wantReason: "no_attestation",
+	}, {
+		desc:       "huge attestation",
+		le:         entry(attest(func(m map[string]interface{}) { m["junk"] = strings.Repeat("x", maxAttestationSize) }), body(certPEM)),
+		wantReason: "too_large",
+	}, {
+		desc:       "attestation not JSON",
+		le:         entry([]byte("{{{{"), body(certPEM)),
+		wantReason: "malformed",
+	}, {
+		desc:       "attestation wrong types",
+		le:         entry([]byte(`{"predicateType":["tlogistry-fetched"],"predicate":7}`), body(certPEM)),
+		wantReason: "malformed",
+	}, {
+		desc:       "wrong statement type",
+		le:         entry(attest(func(m map[string]interface{}) { m["_type"] = "something-else" }), body(certPEM)),
+		wantReason: "invalid_attestation",
+	}, {
+		desc:       "wrong predicate type",
+		le:         entry(attest(func(m map[string]interface{}) { m["predicateType"] = "evil" }), body(certPEM)),
+		wantReason: "invalid_attestation",
+	}, {
+		desc: "other tag",
+		le: entry(attest(func(m map[string]interface{}) {
+			m["predicate"] = map[string]interface{}{"tag": "example.com/foo:other", "digest": digest}
+		}), body(certPEM)),
+		wantReason: "invalid_attestation",
+	}, {
+		desc:       "no subjects",
+		le:         entry(attest(func(m map[string]interface{}) { m["subject"] = []interface{}{} }), body(certPEM)),
+		wantReason: "invalid_attestation",
+	}, {
+		desc: "other digest subject",
+		le: entry(attest(func(m map[string]interface{}) {
+			m["subject"] = append(m["subject"].([]interface{}), map[string]interface{}{
+				"name":   digest,
+				"digest": map[string]string{"sha256": strings.Repeat("b", 64)},
+			})
+		}), body(certPEM)),
+		wantReason: "invalid_attestation",
+	}, {
+		desc: "digest subject with other algorithm",
+		le: entry(attest(func(m map[string]interface{}) {
+			m["subject"] = append(m["subject"].([]interface{}), map[string]interface{}{
+				"name":   digest,
+				"digest": map[string]string{"sha512": strings.TrimPrefix(digest, "sha256:")},
+			})
+		}), body(certPEM)),
+		wantReason: "invalid_attestation",
+	}, {
+		desc: "bad digest",
+		le: entry(attest(func(m map[string]interface{}) {
+			m["predicate"] = map[string]interface{}{"tag": tag.String(), "digest": "sha256:../../etc/passwd"}
+		}), body(certPEM)),
+		wantReason: "invalid_attestation",
+	}, {
+		desc:       "body not a string",
+		le:         entry(attest(nil), map[string]interface{}{"spec": 1}),
+		wantReason: "malformed",
+	}, {
+		desc:       "huge body",
+		le:         entry(attest(nil), strings.Repeat("A", maxBodySize+4)),
+		wantReason: "too_large",
+	}, {
+		desc:       "body not base64",
+		le:         entry(attest(nil), "!!!!"),
+		wantReason: "malformed",
+	}, {
+		desc:       "body not JSON",
+		le:         entry(attest(nil), base64.StdEncoding.EncodeToString([]byte("[[["))),
+		wantReason: "malformed",
+	}, {
+		desc:       "public key not a cert",
+		le:         entry(attest(nil), body([]byte("-----BEGIN PUBLIC KEY-----\nAAAA\n-----END PUBLIC KEY-----\n"))),
+		wantReason: "malformed",
+	}, {
+		desc:       "cert not from Fulcio",
+		le:         entry(attest(nil), body(certPEM)),
+		wantReason: "untrusted_cert",
+	}} {
+		t.Run(c.desc, func(t *testing.T) {
+			err := guard("uuid", func() error {
+				_, _, err := verifyEntry(Canonical(tag), "uuid", c.le, x509.NewCertPool(), x509.NewCertPool())
+				return err
+			})
+			var rej *rejection
+			if !errors.As(err, &rej) {
+				t.Fatalf("verifyEntry: got %v, want rejection", err)
+			}
+			if rej.reason != c.wantReason {
+				t.Errorf("verifyEntry: got reason %q (%v), want %q", rej.reason, err, c.wantReason)
+			}
+		})
+	}
+}
+
+func TestGuardRecoversPanic(t *testing.T) {
+	before := mParsePanics.Value()
+	err := guard("uuid", func() error {
+		var le *rmodels.LogEntryAnon
+		_ = *le.LogIndex // nil pointer dereference.
+		return nil
+	})
+	var rej *rejection
+	if !errors.As(err, &rej) || rej.reason != "panic" {
+		t.Errorf("guard: got %v, want panic rejection", err)
+	}
+	if got := mParsePanics.Value(); got != before+1 {
+		t.Errorf("panics metric: got %v, want %v", got, before+1)
+	}
+}
+
+func TestCertIssuer(t *testing.T) {
+	v2, err := asn1.MarshalWithParams("https://accounts.google.com", "utf8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		desc string
+		exts []pkix.Extension
+		want string
+	}{{
+		desc: "none",
+	}, {
+		desc: "v1",
+		exts: []pkix.Extension{{Id: oidIssuer, Value: []byte("https://accounts.google.com")}},
+		want: "https://accounts.google.com",
+	}, {
+		desc: "v2 preferred",
+		exts: []pkix.Extension{
+			{Id: oidIssuer, Value: []byte("https://evil.example.com")},
+			{Id: oidIssuerV2, Value: v2},
+		},
+		want: "https://accounts.google.com",
+	}} {
+		t.Run(c.desc, func(t *testing.T) {
+			cert := &x509.Certificate{Extensions: c.exts}
+			if got := certIssuer(cert); got != c.want {
+				t.Errorf("certIssuer: got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestCertIdentity(t *testing.T) {
+	spiffe, err := url.Parse("spiffe://example.org/tlogistry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		desc    string
+		cert    *x509.Certificate
+		want    string
+		wantErr bool
+	}{{
+		desc: "email",
+		cert: &x509.Certificate{EmailAddresses: []string{"tlogistry@example.iam.gserviceaccount.com"}},
+		want: "tlogistry@example.iam.gserviceaccount.com",
+	}, {
+		desc: "spiffe",
+		cert: &x509.Certificate{URIs: []*url.URL{spiffe}},
+		want: "spiffe://example.org/tlogistry",
+	}, {
+		desc:    "none",
+		cert:    &x509.Certificate{},
+		wantErr: true,
+	}, {
+		desc:    "both",
+		cert:    &x509.Certificate{EmailAddresses: []string{"a@example.com"}, URIs: []*url.URL{spiffe}},
+		wantErr: true,
+	}} {
+		t.Run(c.desc, func(t *testing.T) {
+			got, err := certIdentity(c.cert)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("certIdentity: got err %v, wantErr %t", err, c.wantErr)
+			}
+			if got != c.want {
+				t.Errorf("certIdentity: got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package rekor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/chainguard-dev/tlogistry/internal/digests"
+	rindex "github.com/sigstore/rekor/pkg/generated/client/index"
+	rmodels "github.com/sigstore/rekor/pkg/generated/models"
+	"github.com/sigstore/sigstore/pkg/fulcioroots"
+)
+
+// TagPin is an entry that pinned a tag.
+type TagPin struct {
+	Tag string
+	*Info
+}
+
+// WhoHas searches Rekor for entries that pinned tags to the digest, signed
+// by a Fulcio cert associated with our identity, and returns them oldest
+// first. Only entries written since pins were indexed by digest are found.
+func WhoHas(ctx context.Context, digest string) ([]TagPin, error) {
+	alg, hex, err := digests.Parse(digest)
+	if err != nil {
+		return nil, err
+	}
+	if env.RekorAPI == "v2" {
+		return nil, errors.New("searching by digest isn't supported by the Rekor v2 API")
+	}
+	roots, err := fulcioroots.Get()
+	if err != nil {
+		return nil, fmt.Errorf("getting Fulcio root cert: %w", err)
+	}
+	intermediates, err := fulcioroots.GetIntermediates()
+	if err != nil {
+		return nil, fmt.Errorf("getting Fulcio intermedate certs: %w", err)
+	}
+
+	iparams := rindex.NewSearchIndexParams()
+	iparams.SetTimeout(env.RekorTimeout)
+	iparams.SetContext(ctx)
+	// Rekor takes sha256 hashes bare, and others prefixed with their
+	// algorithm.
+	hash := alg + ":" + hex
+	if alg == digests.Canonical {
+		hash = hex
+	}
+	iparams.SetQuery(&rmodels.SearchIndex{Hash: hash})
+	start := time.Now()
+	iresp, err := rekorClient.Index.SearchIndex(iparams)
+	observe(start, err)
+	if err != nil {
+		return nil, fmt.Errorf("querying Rekor entries: %w", err)
+	}
+	if len(iresp.Payload) > maxEntries {
+		log.Printf("found %d entries for %s, only checking the first %d", len(iresp.Payload), digest, maxEntries)
+		iresp.Payload = iresp.Payload[:maxEntries]
+	}
+	var pins []TagPin
+	for _, e := range iresp.Payload {
+		le, err := getEntry(ctx, e)
+		if err != nil {
+			log.Printf("error getting Rekor entry: %v", err)
+			continue
+		}
+		var pin TagPin
+		if err := guard(e, func() error {
+			if le.Attestation == nil {
+				return reject("no_attestation", errors.New("no attestation"))
+			}
+			att, err := parseAttestation(le.Attestation.Data)
+			if err != nil {
+				return reject("malformed", err)
+			}
+			got, info, err := verifyEntry(att.Predicate.Tag, e, le, roots, intermediates)
+			if err != nil {
+				return err
+			}
+			if got != digest {
+				return reject("invalid_attestation", fmt.Errorf("entry pins %q, want %q", got, digest))
+			}
+			pin = TagPin{Tag: att.Predicate.Tag, Info: info}
+			return nil
+		}); err != nil {
+			var rej *rejection
+			if errors.As(err, &rej) {
+				mRejected.Inc(rej.reason)
+			}
+			log.Printf("decoding %q: %v", e, err)
+			continue
+		}
+		pins = append(pins, pin)
+	}
+	sort.Slice(pins, func(i, j int) bool { return pins[i].LogIndex < pins[j].LogIndex })
+	return pins, nil
+}
@@ -0,0 +1,119 @@
+package scan
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// httpScanner POSTs {"image": "<ref>"} to a scanner endpoint, which responds
+// with the number of vulnerabilities by severity, e.g., {"CRITICAL": 1}.
+//
+// This is a thin adapter that can be put in front of Grype or Trivy servers.
+type httpScanner struct{ url string }
+
+func (s httpScanner) scan(ctx context.Context, ref name.Digest) (map[string]int, error) {
+	b, err := json.Marshal(map[string]string{"image": ref.String()})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var counts map[string]int
+	if err := do(req, &counts); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// containerAnalysis queries GCP Container Analysis for vulnerability
+// occurrences of the image, using the instance's service account.
+type containerAnalysis struct{ project string }
+
+// maxPages is the most pages of occurrences that are read.
+const maxPages = 20
+
+func (c containerAnalysis) scan(ctx context.Context, ref name.Digest) (map[string]int, error) {
+	token, err := accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	filter := fmt.Sprintf(`kind="VULNERABILITY" AND resourceUrl="https://%s"`, ref.String())
+	counts := map[string]int{}
+	page := ""
+	for i := 0; i < maxPages; i++ {
+		q := url.Values{"filter": {filter}, "pageSize": {"1000"}}
+		if page != "" {
+			q.Set("pageToken", page)
+		}
+		u := fmt.Sprintf("https://containeranalysis.googleapis.com/v1/projects/%s/occurrences?%s", url.PathEscape(c.project), q.Encode())
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		var resp struct {
+			Occurrences []struct {
+				Vulnerability struct {
+					EffectiveSeverity string `json:"effectiveSeverity"`
+					Severity          string `json:"severity"`
+				} `json:"vulnerability"`
+			} `json:"occurrences"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := do(req, &resp); err != nil {
+			return nil, err
+		}
+		for _, o := range resp.Occurrences {
+			sev := o.Vulnerability.EffectiveSeverity
+			if sev == "" {
+				sev = o.Vulnerability.Severity
+			}
+			counts[sev]++
+		}
+		if page = resp.NextPageToken; page == "" {
+			return counts, nil
+		}
+	}
+	return nil, fmt.Errorf("more than %d pages of occurrences", maxPages)
+}
+
+// accessToken gets an OAuth access token for the instance's service account
+// from the GCE metadata server.
+func accessToken(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	var tok struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := do(req, &tok); err != nil {
+		return "", fmt.Errorf("getting access token: %w", err)
+	}
+	return tok.AccessToken, nil
+}
+
+// do sends the request, and decodes the JSON response into v.
+func do(req *http.Request, v interface{}) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("unexpected status code (%s): %d: %s", req.URL.Redacted(), resp.StatusCode, b)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 10<<20)).Decode(v)
+}
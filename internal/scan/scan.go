@@ -0,0 +1,124 @@
+// Package scan queries a vulnerability scanner about images before they're
+// first pinned.
+package scan
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/chainguard-dev/tlogistry/internal/config"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/kelseyhightower/envconfig"
+)
+
+// Severities, from most to least severe.
+var Severities = []string{"CRITICAL", "HIGH", "MEDIUM", "LOW"}
+
+var env struct {
+	// Backend is the scanner to query: "http" or "containeranalysis". If
+	// it's not set, images aren't scanned.
+	Backend string `envconfig:"SCAN_BACKEND"`
+	// URL is the endpoint of the http backend.
+	URL string `envconfig:"SCAN_URL"`
+	// Project is the GCP project of the containeranalysis backend.
+	Project string `envconfig:"SCAN_PROJECT"`
+	// Threshold is the least severe vulnerability that fails the gate.
+	Threshold string `envconfig:"SCAN_THRESHOLD" default:"CRITICAL"`
+	// Policy is config.Enforce, which blocks images that fail the gate, or
+	// config.Warn, which serves them with a warning.
+	Policy string `envconfig:"SCAN_POLICY" default:"enforce"`
+}
+
+var scanner interface {
+	scan(ctx context.Context, ref name.Digest) (map[string]int, error)
+}
+
+func init() {
+	if err := envconfig.Process("", &env); err != nil {
+		log.Fatalf("envconfig: %v", err)
+	}
+	env.Threshold = strings.ToUpper(env.Threshold)
+	if rank(env.Threshold) < 0 {
+		log.Fatalf("SCAN_THRESHOLD must be one of %v, got %q", Severities, env.Threshold)
+	}
+	if env.Policy != config.Enforce && env.Policy != config.Warn {
+		log.Fatalf("SCAN_POLICY must be %q or %q, got %q", config.Enforce, config.Warn, env.Policy)
+	}
+	switch env.Backend {
+	case "":
+	case "http":
+		if env.URL == "" {
+			log.Fatal("SCAN_URL is required for the http scan backend")
+		}
+		scanner = httpScanner{url: env.URL}
+	case "containeranalysis":
+		if env.Project == "" {
+			log.Fatal("SCAN_PROJECT is required for the containeranalysis scan backend")
+		}
+		scanner = containerAnalysis{project: env.Project}
+	default:
+		log.Fatalf("unknown SCAN_BACKEND %q", env.Backend)
+	}
+}
+
+// Enabled reports whether images are scanned.
+func Enabled() bool { return scanner != nil }
+
+// Enforced reports whether images that fail the gate are blocked, rather
+// than served with a warning.
+func Enforced() bool { return env.Policy != config.Warn }
+
+// Summary is the number of vulnerabilities found in an image, by severity.
+type Summary struct {
+	Scanner string         `json:"scanner"`
+	Counts  map[string]int `json:"counts"`
+	// Failed is whether there are vulnerabilities at or above the
+	// threshold severity.
+	Failed    bool   `json:"failed"`
+	Threshold string `json:"threshold"`
+}
+
+func (s *Summary) String() string {
+	var parts []string
+	for _, sev := range Severities {
+		if n := s.Counts[sev]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, sev))
+		}
+	}
+	if len(parts) == 0 {
+		return "no vulnerabilities"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Scan scans the image, and reports whether it passes the gate.
+func Scan(ctx context.Context, ref name.Digest) (*Summary, error) {
+	counts, err := scanner.scan(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("scanning %s: %w", ref, err)
+	}
+	s := &Summary{Scanner: env.Backend, Counts: map[string]int{}, Threshold: env.Threshold}
+	for sev, n := range counts {
+		sev = strings.ToUpper(sev)
+		if rank(sev) < 0 {
+			continue // e.g., NEGLIGIBLE or UNKNOWN.
+		}
+		s.Counts[sev] += n
+		if n > 0 && rank(sev) <= rank(env.Threshold) {
+			s.Failed = true
+		}
+	}
+	return s, nil
+}
+
+// rank returns the index of the severity in Severities, or -1.
+func rank(severity string) int {
+	for i, s := range Severities {
+		if s == severity {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,64 @@
+package scan
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+type fakeScanner map[string]int
+
+func (f fakeScanner) scan(context.Context, name.Digest) (map[string]int, error) { return f, nil }
+
+func TestScan(t *testing.T) {
+	ref, err := name.NewDigest("example.com/app@sha256:0000000000000000000000000000000000000000000000000000000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(th string) { scanner, env.Threshold = nil, th }(env.Threshold)
+
+	for _, c := range []struct {
+		desc      string
+		counts    map[string]int
+		threshold string
+		want      string
+		failed    bool
+	}{{
+		desc:      "clean",
+		counts:    map[string]int{},
+		threshold: "CRITICAL",
+		want:      "no vulnerabilities",
+	}, {
+		desc:      "below threshold",
+		counts:    map[string]int{"HIGH": 2, "low": 1, "NEGLIGIBLE": 5},
+		threshold: "CRITICAL",
+		want:      "2 HIGH, 1 LOW",
+	}, {
+		desc:      "at threshold",
+		counts:    map[string]int{"HIGH": 2},
+		threshold: "HIGH",
+		want:      "2 HIGH",
+		failed:    true,
+	}, {
+		desc:      "above threshold",
+		counts:    map[string]int{"CRITICAL": 1, "MEDIUM": 3},
+		threshold: "MEDIUM",
+		want:      "1 CRITICAL, 3 MEDIUM",
+		failed:    true,
+	}} {
+		t.Run(c.desc, func(t *testing.T) {
+			scanner, env.Threshold = fakeScanner(c.counts), c.threshold
+			s, err := Scan(context.Background(), ref)
+			if err != nil {
+				t.Fatalf("Scan: %v", err)
+			}
+			if got := s.String(); got != c.want {
+				t.Errorf("Scan: got %q, want %q", got, c.want)
+			}
+			if s.Failed != c.failed {
+				t.Errorf("Scan: got failed %t, want %t", s.Failed, c.failed)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+// Package secrets resolves references to secrets, so credentials don't have
+// to be given in the clear in environment variables or the config file.
+//
+// References are URIs:
+//   - gcp-sm://projects/[PROJECT]/secrets/[SECRET]/versions/[VERSION], a GCP Secret Manager secret version
+//   - vault://[PATH]#[FIELD], a field of a HashiCorp Vault secret, at VAULT_ADDR with VAULT_TOKEN
+//   - file://[PATH], the contents of a file, like a mounted Kubernetes secret
+//
+// Anything else is used as-is.
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+var env struct {
+	// RefreshInterval is how long resolved secrets are cached before
+	// they're resolved again, to pick up rotations.
+	RefreshInterval time.Duration `envconfig:"SECRET_REFRESH_INTERVAL" default:"5m"`
+	VaultAddr       string        `envconfig:"VAULT_ADDR"`
+	VaultToken      string        `envconfig:"VAULT_TOKEN"`
+	// VaultTokenFile is a file containing the Vault token, which is reread
+	// for each use, e.g., one kept fresh by a Vault agent.
+	VaultTokenFile string `envconfig:"VAULT_TOKEN_FILE"`
+}
+
+func init() {
+	if err := envconfig.Process("", &env); err != nil {
+		log.Fatalf("envconfig: %v", err)
+	}
+}
+
+var sources = map[string]func(ctx context.Context, path string) (string, error){
+	"gcp-sm": secretManager,
+	"vault":  vault,
+	"file":   file,
+}
+
+// IsRef reports whether s is a reference to a secret.
+func IsRef(s string) bool {
+	scheme, _, ok := strings.Cut(s, "://")
+	return ok && sources[scheme] != nil
+}
+
+// Fetch resolves the reference, without caching, or returns s if it isn't a
+// reference.
+func Fetch(ctx context.Context, s string) (string, error) {
+	scheme, path, ok := strings.Cut(s, "://")
+	if !ok || sources[scheme] == nil {
+		return s, nil
+	}
+	v, err := sources[scheme](ctx, path)
+	if err != nil {
+		return "", fmt.Errorf("resolving secret %s: %w", s, err)
+	}
+	return v, nil
+}
+
+type cached struct {
+	value   string
+	fetched time.Time
+}
+
+var cache sync.Map // ref -> cached
+
+// Resolve resolves the reference, or returns s if it isn't a reference.
+//
+// Resolved secrets are cached for SECRET_REFRESH_INTERVAL. If resolving a
+// secret again fails, the cached value is used until it succeeds.
+func Resolve(ctx context.Context, s string) (string, error) {
+	if !IsRef(s) {
+		return s, nil
+	}
+	c, ok := cache.Load(s)
+	if ok && time.Since(c.(cached).fetched) < env.RefreshInterval {
+		return c.(cached).value, nil
+	}
+	v, err := Fetch(ctx, s)
+	if err != nil {
+		if ok {
+			log.Println("!!! ERROR REFRESHING SECRET, USING CACHED VALUE:", err)
+			return c.(cached).value, nil
+		}
+		return "", err
+	}
+	cache.Store(s, cached{value: v, fetched: time.Now()})
+	return v, nil
+}
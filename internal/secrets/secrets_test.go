@@ -0,0 +1,46 @@
+package secrets
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResolveFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ref := "file://" + path
+	ctx := context.Background()
+
+	if got, err := Resolve(ctx, "not-a-ref"); err != nil || got != "not-a-ref" {
+		t.Errorf("Resolve(not-a-ref): got %q, %v", got, err)
+	}
+	if got, err := Resolve(ctx, ref); err != nil || got != "hunter2" {
+		t.Errorf("Resolve: got %q, %v", got, err)
+	}
+
+	// Rotations are picked up once the cached value is stale.
+	if err := os.WriteFile(path, []byte("correct-horse"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := Resolve(ctx, ref); got != "hunter2" {
+		t.Errorf("Resolve: got %q, want cached value", got)
+	}
+	defer func(d time.Duration) { env.RefreshInterval = d }(env.RefreshInterval)
+	env.RefreshInterval = 0
+	if got, _ := Resolve(ctx, ref); got != "correct-horse" {
+		t.Errorf("Resolve: got %q, want rotated value", got)
+	}
+
+	// If the secret can't be resolved again, the cached value is used.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Resolve(ctx, ref); err != nil || got != "correct-horse" {
+		t.Errorf("Resolve: got %q, %v, want cached value", got, err)
+	}
+}
@@ -0,0 +1,120 @@
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// secretManager reads a GCP Secret Manager secret version, using the
+// instance's service account.
+func secretManager(ctx context.Context, version string) (string, error) {
+	token, err := accessToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://secretmanager.googleapis.com/v1/"+version+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	var resp struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := do(req, &resp); err != nil {
+		return "", err
+	}
+	b, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("decoding secret: %w", err)
+	}
+	return string(b), nil
+}
+
+// vault reads a field of a Vault secret, given as path#field, from either a
+// KV version 1 or 2 secrets engine.
+func vault(ctx context.Context, ref string) (string, error) {
+	if env.VaultAddr == "" {
+		return "", errors.New("VAULT_ADDR isn't set")
+	}
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok {
+		return "", errors.New("no #field in Vault reference")
+	}
+	token := env.VaultToken
+	if env.VaultTokenFile != "" {
+		b, err := os.ReadFile(env.VaultTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("reading Vault token: %w", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(env.VaultAddr, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := do(req, &resp); err != nil {
+		return "", err
+	}
+	data := resp.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		data = inner // KV version 2.
+	}
+	v, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("no string field %q", field)
+	}
+	return v, nil
+}
+
+// file reads a file, without any trailing newline.
+func file(_ context.Context, path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// accessToken gets an OAuth access token for the instance's service account
+// from the GCE metadata server.
+func accessToken(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	var tok struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := do(req, &tok); err != nil {
+		return "", fmt.Errorf("getting access token: %w", err)
+	}
+	return tok.AccessToken, nil
+}
+
+// do sends the request, and decodes the JSON response into v.
+func do(req *http.Request, v interface{}) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("unexpected status code (%s): %d: %s", req.URL.Redacted(), resp.StatusCode, b)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
@@ -0,0 +1,240 @@
+// Package syslog forwards security events, like mismatches, new pins and
+// policy denials, to a syslog collector, as RFC 5424 messages or as CEF
+// (ArcSight Common Event Format) in RFC 5424 messages.
+//
+// Events are queued and sent in the background. If the queue is full, or
+// the collector can't be reached, events are dropped rather than holding up
+// requests.
+package syslog
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chainguard-dev/tlogistry/internal/audit"
+	"github.com/chainguard-dev/tlogistry/internal/metrics"
+	"github.com/chainguard-dev/tlogistry/internal/version"
+	"github.com/kelseyhightower/envconfig"
+)
+
+const (
+	appName = "tlogistry"
+	// sdID identifies tlogistry's structured data, under the example
+	// private enterprise number from RFC 5612.
+	sdID = "tlogistry@32473"
+	// facility is local0.
+	facility = 16
+)
+
+var env struct {
+	// Addr is the collector, as udp://host:port, tcp://host:port or
+	// tls://host:port.
+	Addr string `envconfig:"SYSLOG_ADDR"`
+	// Format is rfc5424 or cef.
+	Format    string   `envconfig:"SYSLOG_FORMAT" default:"rfc5424"`
+	Events    []string `envconfig:"SYSLOG_EVENTS" default:"pinned,mismatch,denied"`
+	QueueSize int      `envconfig:"SYSLOG_QUEUE_SIZE" default:"10000"`
+}
+
+var (
+	mSent = metrics.NewCounter("tlogistry_syslog_events_total",
+		"Audit events sent to syslog, by result.", "result")
+
+	kinds    = map[audit.Kind]bool{}
+	queue    chan audit.Event
+	hostname = "-"
+)
+
+func init() {
+	if err := envconfig.Process("", &env); err != nil {
+		log.Fatalf("envconfig: %v", err)
+	}
+	if env.Format != "rfc5424" && env.Format != "cef" {
+		log.Fatalf("SYSLOG_FORMAT must be rfc5424 or cef, got %q", env.Format)
+	}
+	for _, k := range env.Events {
+		kinds[audit.Kind(strings.TrimSpace(k))] = true
+	}
+	if h, err := os.Hostname(); err == nil && h != "" {
+		hostname = h
+	}
+}
+
+// Enabled reports whether events are forwarded.
+func Enabled() bool { return env.Addr != "" }
+
+// Start forwards events recorded from now on.
+func Start() {
+	u, err := url.Parse(env.Addr)
+	if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp" && u.Scheme != "tls") || u.Host == "" {
+		log.Fatalf("SYSLOG_ADDR must be udp://, tcp:// or tls://host:port, got %q", env.Addr)
+	}
+	queue = make(chan audit.Event, env.QueueSize)
+	audit.AddSink(enqueue)
+	go run(u)
+}
+
+// enqueue queues the event, if it's of a kind that's forwarded.
+func enqueue(e audit.Event) {
+	if !kinds[e.Kind] {
+		return
+	}
+	select {
+	case queue <- e:
+	default:
+		mSent.Inc("dropped")
+	}
+}
+
+// run sends queued events to the collector, reconnecting as needed.
+func run(u *url.URL) {
+	var conn net.Conn
+	for e := range queue {
+		msg := format(e, time.Now())
+		for i := 0; i < 2; i++ {
+			if conn == nil {
+				var err error
+				if conn, err = dial(u); err != nil {
+					log.Printf("!!! ERROR CONNECTING TO SYSLOG: %v", err)
+					break
+				}
+			}
+			if err := send(conn, u.Scheme, msg); err != nil {
+				// The collector might have closed the connection, so
+				// try once more with a new one.
+				log.Printf("!!! ERROR SENDING TO SYSLOG: %v", err)
+				conn.Close()
+				conn = nil
+				continue
+			}
+			mSent.Inc("ok")
+			msg = ""
+			break
+		}
+		if msg != "" {
+			mSent.Inc("dropped")
+		}
+	}
+}
+
+func dial(u *url.URL) (net.Conn, error) {
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	if u.Scheme == "tls" {
+		return tls.DialWithDialer(d, "tcp", u.Host, &tls.Config{MinVersion: tls.VersionTLS12})
+	}
+	return d.Dial(u.Scheme, u.Host)
+}
+
+// send writes the message, one per datagram over UDP, and with octet
+// counting framing (RFC 6587) over TCP.
+func send(conn net.Conn, scheme, msg string) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return err
+	}
+	if scheme != "udp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	_, err := conn.Write([]byte(msg))
+	return err
+}
+
+// severity returns the syslog severity of the event: warning for mismatches
+// and denials, and informational otherwise.
+func severity(e audit.Event) int {
+	switch e.Kind {
+	case audit.Mismatch, audit.Denied:
+		return 4
+	}
+	return 6
+}
+
+// format formats the event as an RFC 5424 message, whose MSG is CEF if
+// that's the format.
+func format(e audit.Event, now time.Time) string {
+	if e.Time.IsZero() {
+		e.Time = now
+	}
+	header := fmt.Sprintf("<%d>1 %s %s %s %d %s", facility*8+severity(e), e.Time.UTC().Format(time.RFC3339Nano), hostname, appName, os.Getpid(), e.Kind)
+	if env.Format == "cef" {
+		return header + " - " + cef(e)
+	}
+	var sd strings.Builder
+	sd.WriteString("[" + sdID)
+	for _, p := range [][2]string{{"repo", e.Repo}, {"tag", e.Tag}, {"digest", e.Digest}, {"want", e.Want}, {"uuid", e.UUID}} {
+		if p[1] != "" {
+			fmt.Fprintf(&sd, ` %s="%s"`, p[0], sdEscaper.Replace(p[1]))
+		}
+	}
+	sd.WriteString("]")
+	return header + " " + sd.String() + " " + message(e)
+}
+
+// message describes the event in words.
+func message(e audit.Event) string {
+	var msg string
+	switch e.Kind {
+	case audit.Pinned:
+		msg = fmt.Sprintf("pinned %s to %s", e.Tag, e.Digest)
+	case audit.Mismatch:
+		msg = fmt.Sprintf("tag %s is %s, but is pinned to %s", e.Tag, e.Digest, e.Want)
+	case audit.Denied:
+		msg = fmt.Sprintf("denied %s@%s by policy", e.Repo, e.Digest)
+	default:
+		msg = string(e.Kind)
+	}
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+var (
+	sdEscaper        = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefValueEscaper  = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
+
+// cefNames are the CEF event names of kinds of events.
+var cefNames = map[audit.Kind]string{
+	audit.Pinned:   "Tag pinned",
+	audit.Mismatch: "Digest mismatch",
+	audit.Denied:   "Denied by policy",
+}
+
+// cef formats the event in ArcSight's Common Event Format.
+func cef(e audit.Event) string {
+	sev := map[audit.Kind]int{audit.Mismatch: 8, audit.Denied: 6}[e.Kind]
+	if sev == 0 {
+		sev = 3
+	}
+	ver := version.Commit
+	if ver == "" {
+		ver = "unknown"
+	}
+	var ext strings.Builder
+	fmt.Fprintf(&ext, "rt=%d", e.Time.UnixMilli())
+	for _, p := range [][3]string{
+		{"cs1", "tag", e.Tag},
+		{"cs2", "digest", e.Digest},
+		{"cs3", "pinnedDigest", e.Want},
+		{"cs4", "rekorUUID", e.UUID},
+		{"cs5", "repo", e.Repo},
+	} {
+		if p[2] != "" {
+			fmt.Fprintf(&ext, " %sLabel=%s %s=%s", p[0], p[1], p[0], cefValueEscaper.Replace(p[2]))
+		}
+	}
+	fmt.Fprintf(&ext, " msg=%s", cefValueEscaper.Replace(message(e)))
+	name, ok := cefNames[e.Kind]
+	if !ok {
+		name = string(e.Kind)
+	}
+	return fmt.Sprintf("CEF:0|Chainguard|tlogistry|%s|%s|%s|%d|%s",
+		cefHeaderEscaper.Replace(ver), e.Kind, cefHeaderEscaper.Replace(name), sev, ext.String())
+}
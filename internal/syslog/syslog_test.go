@@ -0,0 +1,92 @@
+package syslog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/tlogistry/internal/audit"
+)
+
+func TestFormat(t *testing.T) {
+	defer func(old, host string) { env.Format, hostname = old, host }(env.Format, hostname)
+	hostname = "tlog-1"
+	at := time.Date(2022, 6, 28, 13, 3, 37, 0, time.UTC)
+	e := audit.Event{
+		Time:   at,
+		Kind:   audit.Mismatch,
+		Repo:   "example.com/app",
+		Tag:    "example.com/app:v1",
+		Digest: "sha256:bbbb",
+		Want:   "sha256:aaaa",
+		UUID:   "1234",
+	}
+	pid := os.Getpid()
+
+	env.Format = "rfc5424"
+	want := fmt.Sprintf(`<132>1 2022-06-28T13:03:37Z tlog-1 tlogistry %d mismatch [tlogistry@32473 repo="example.com/app" tag="example.com/app:v1" digest="sha256:bbbb" want="sha256:aaaa" uuid="1234"] tag example.com/app:v1 is sha256:bbbb, but is pinned to sha256:aaaa`, pid)
+	if got := format(e, at); got != want {
+		t.Errorf("rfc5424:\ngot  %s\nwant %s", got, want)
+	}
+
+	env.Format = "cef"
+	want = fmt.Sprintf(`<132>1 2022-06-28T13:03:37Z tlog-1 tlogistry %d mismatch - CEF:0|Chainguard|tlogistry|unknown|mismatch|Digest mismatch|8|rt=1656421417000 cs1Label=tag cs1=example.com/app:v1 cs2Label=digest cs2=sha256:bbbb cs3Label=pinnedDigest cs3=sha256:aaaa cs4Label=rekorUUID cs4=1234 cs5Label=repo cs5=example.com/app msg=tag example.com/app:v1 is sha256:bbbb, but is pinned to sha256:aaaa`, pid)
+	if got := format(e, at); got != want {
+		t.Errorf("cef:\ngot  %s\nwant %s", got, want)
+	}
+
+	env.Format = "rfc5424"
+	denied := audit.Event{Time: at, Kind: audit.Denied, Repo: "example.com/app", Digest: "sha256:aaaa", Detail: `too "new"] = bad`}
+	want = fmt.Sprintf(`<132>1 2022-06-28T13:03:37Z tlog-1 tlogistry %d denied [tlogistry@32473 repo="example.com/app" digest="sha256:aaaa"] denied example.com/app@sha256:aaaa by policy: too "new"] = bad`, pid)
+	if got := format(denied, at); got != want {
+		t.Errorf("denied:\ngot  %s\nwant %s", got, want)
+	}
+	env.Format = "cef"
+	if got, want := cef(denied), `msg=denied example.com/app@sha256:aaaa by policy: too "new"] \= bad`; !strings.HasSuffix(got, want) {
+		t.Errorf("cef(denied) = %s, want %s", got, want)
+	}
+}
+
+func TestSend(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	got := make(chan string)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		var n int
+		if _, err := fmt.Fscanf(r, "%d ", &n); err != nil {
+			got <- err.Error()
+			return
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			got <- err.Error()
+			return
+		}
+		got <- string(b)
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := send(c, "tcp", "<134>1 - - tlogistry - pinned - hello"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-got; msg != "<134>1 - - tlogistry - pinned - hello" {
+		t.Errorf("got %q", msg)
+	}
+}
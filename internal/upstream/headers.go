@@ -0,0 +1,37 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/chainguard-dev/tlogistry/internal/config"
+	"github.com/chainguard-dev/tlogistry/internal/secrets"
+	"github.com/chainguard-dev/tlogistry/internal/version"
+)
+
+// UserAgent identifies tlogistry to upstream registries.
+var UserAgent = "tlogistry/" + commit()
+
+func commit() string {
+	if version.Commit == "" {
+		return "unknown"
+	}
+	return version.Commit
+}
+
+// headerTransport sets tlogistry's User-Agent and any configured headers on
+// requests to upstreams.
+type headerTransport struct{ next http.RoundTripper }
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", UserAgent)
+	for k, v := range config.Get().Upstreams[req.URL.Host].Headers {
+		v, err := secrets.Resolve(req.Context(), v)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %w", k, err)
+		}
+		req.Header.Set(k, v)
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,124 @@
+package upstream
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// window is the number of recent requests considered per upstream.
+	window = 20
+	// minSamples is the number of requests needed before an upstream can be
+	// considered unhealthy.
+	minSamples = 5
+	// maxErrorRate is the error rate above which an upstream is unhealthy.
+	maxErrorRate = 0.5
+)
+
+// Score summarizes the recent behavior of an upstream host.
+type Score struct {
+	Host        string        `json:"host"`
+	Requests    int64         `json:"requests"`
+	Errors      int64         `json:"errors"`
+	ErrorRate   float64       `json:"errorRate"` // over the recent window.
+	Latency     time.Duration `json:"latency"`   // moving average.
+	LastError   string        `json:"lastError,omitempty"`
+	LastErrorAt time.Time     `json:"lastErrorAt,omitempty"`
+	Healthy     bool          `json:"healthy"`
+	Mirror      string        `json:"mirror,omitempty"`
+}
+
+type hostStats struct {
+	requests, errors int64
+	recent           []bool // true for failures, most recent last.
+	latency          time.Duration
+	lastError        string
+	lastErrorAt      time.Time
+	lastSeen         time.Time
+}
+
+var (
+	scoresMu sync.Mutex
+	scores   = map[string]*hostStats{}
+)
+
+// observe records the outcome of a request to host.
+func observe(host string, latency time.Duration, status int, err error) {
+	failed := err != nil || status >= 500 || status == http.StatusTooManyRequests
+
+	scoresMu.Lock()
+	defer scoresMu.Unlock()
+	s, ok := scores[host]
+	if !ok {
+		s = &hostStats{latency: latency}
+		scores[host] = s
+	}
+	s.requests++
+	s.lastSeen = time.Now()
+	s.latency = (s.latency*7 + latency) / 8
+	s.recent = append(s.recent, failed)
+	if len(s.recent) > window {
+		s.recent = s.recent[len(s.recent)-window:]
+	}
+	if failed {
+		s.errors++
+		s.lastErrorAt = time.Now()
+		if err != nil {
+			s.lastError = err.Error()
+		} else {
+			s.lastError = http.StatusText(status)
+		}
+	}
+}
+
+func (s *hostStats) errorRate() float64 {
+	if len(s.recent) == 0 {
+		return 0
+	}
+	n := 0
+	for _, f := range s.recent {
+		if f {
+			n++
+		}
+	}
+	return float64(n) / float64(len(s.recent))
+}
+
+func (s *hostStats) healthy() bool {
+	if len(s.recent) < minSamples || s.errorRate() <= maxErrorRate {
+		return true
+	}
+	// Let a request through once in a while to see if it's recovered.
+	return time.Since(s.lastSeen) > env.Cooldown
+}
+
+func healthy(host string) bool {
+	scoresMu.Lock()
+	defer scoresMu.Unlock()
+	s, ok := scores[host]
+	return !ok || s.healthy()
+}
+
+// Scores returns the scoreboard of upstream hosts, sorted by host.
+func Scores() []Score {
+	scoresMu.Lock()
+	defer scoresMu.Unlock()
+	out := make([]Score, 0, len(scores))
+	for host, s := range scores {
+		out = append(out, Score{
+			Host:        host,
+			Requests:    s.requests,
+			Errors:      s.errors,
+			ErrorRate:   s.errorRate(),
+			Latency:     s.latency,
+			LastError:   s.lastError,
+			LastErrorAt: s.lastErrorAt,
+			Healthy:     s.healthy(),
+			Mirror:      env.Mirrors[host],
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Host < out[j].Host })
+	return out
+}
@@ -0,0 +1,268 @@
+// Package upstream talks to the upstream registries that tlogistry proxies.
+package upstream
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	authchallenge "github.com/docker/distribution/registry/client/auth/challenge"
+	"github.com/kelseyhightower/envconfig"
+)
+
+var env struct {
+	// Mirrors maps upstream registry hosts to mirrors that serve the same
+	// content, which are used when the upstream is unhealthy.
+	Mirrors map[string]string `envconfig:"MIRRORS"`
+	// Cooldown is how long to wait before retrying an unhealthy upstream.
+	Cooldown time.Duration `envconfig:"UPSTREAM_COOLDOWN" default:"30s"`
+}
+
+func init() {
+	if err := envconfig.Process("", &env); err != nil {
+		log.Fatalf("envconfig: %v", err)
+	}
+}
+
+// Transport sends requests to upstream registries, and records their outcomes
+// in the scoreboard. It doesn't follow redirects.
+var Transport http.RoundTripper = &observingTransport{&headerTransport{http.DefaultTransport}}
+
+// Client sends requests to upstream registries using Transport, following
+// redirects.
+var Client = &http.Client{Transport: Transport}
+
+type observingTransport struct{ next http.RoundTripper }
+
+func (t *observingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	observe(req.URL.Host, time.Since(start), status, err)
+	return resp, err
+}
+
+// Route returns the host to send requests for the registry to: the registry
+// itself, unless it's unhealthy and has a mirror.
+func Route(registry string) string {
+	mirror, ok := env.Mirrors[registry]
+	if !ok || healthy(registry) {
+		return registry
+	}
+	if !healthy(mirror) {
+		return registry // Both are unhealthy, prefer the real thing.
+	}
+	log.Printf("=== UPSTREAM: %s is unhealthy, failing over to %s", registry, mirror)
+	return mirror
+}
+
+// tokenExpiryMargin is how long before they expire cached tokens are
+// refreshed.
+const tokenExpiryMargin = 10 * time.Second
+
+// defaultTokenTTL is how long tokens last when the token server doesn't
+// say, per the distribution token spec, and how long a registry that
+// doesn't require auth is remembered.
+const defaultTokenTTL = 60 * time.Second
+
+// maxTokens is the most tokens cached before the cache is cleared.
+const maxTokens = 10000
+
+var tokens = struct {
+	sync.Mutex
+	m map[string]*cachedToken // by host and scope
+}{m: map[string]*cachedToken{}}
+
+type cachedToken struct {
+	mu         sync.Mutex // Held while fetching, so concurrent callers share a token.
+	token      string
+	renew      time.Time // After which the token is renewed in the background.
+	expires    time.Time
+	refreshing bool
+}
+
+// set caches the Authorization header value auth, which lasts for ttl. It's
+// renewed once three quarters of that has passed, so a client pulling a
+// manifest and then its blobs keeps using a live token rather than waiting
+// for a new one partway through.
+func (ct *cachedToken) set(auth string, ttl time.Duration) {
+	ct.token = strings.TrimPrefix(auth, "Bearer ")
+	ttl -= tokenExpiryMargin
+	ct.expires = time.Now().Add(ttl)
+	ct.renew = time.Now().Add(ttl * 3 / 4)
+}
+
+// scope returns the token scope for the actions on the repository.
+func scope(repository, actions string) string {
+	return fmt.Sprintf("repository:%s:%s", repository, actions)
+}
+
+// tokenKey returns the key of the cached token for the scope on the host.
+// Tokens are only reused for the same scope: a token for one repository says
+// nothing about another, and one for pulls says nothing about pushes.
+func tokenKey(host, scope string) string {
+	return host + " " + scope
+}
+
+// Token returns a token to pull from the repository on the given registry
+// host, or "" if the registry doesn't require auth.
+//
+// Tokens are cached until they expire, since clients like buildkit fetch an
+// image's blobs in parallel, and pull a manifest and then its blobs in quick
+// succession. Tokens in use are renewed before they expire.
+func Token(host, repository string) (string, error) {
+	key := tokenKey(host, scope(repository, "pull"))
+	tokens.Lock()
+	ct, ok := tokens.m[key]
+	if !ok {
+		if len(tokens.m) >= maxTokens {
+			tokens.m = map[string]*cachedToken{}
+		}
+		ct = &cachedToken{}
+		tokens.m[key] = ct
+	}
+	tokens.Unlock()
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	now := time.Now()
+	if now.Before(ct.expires) {
+		if !now.Before(ct.renew) && !ct.refreshing {
+			ct.refreshing = true
+			go renewToken(ct, host, repository)
+		}
+		return ct.token, nil
+	}
+	auth, ttl, err := authorize(host, repository, "pull", "", "")
+	if err != nil {
+		return "", err
+	}
+	ct.set(auth, ttl)
+	return ct.token, nil
+}
+
+// renewToken replaces the cached token with a new one. If that fails, the
+// cached token is used until it expires.
+func renewToken(ct *cachedToken, host, repository string) {
+	auth, ttl, err := authorize(host, repository, "pull", "", "")
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.refreshing = false
+	if err != nil {
+		log.Printf("=== UPSTREAM: renewing token for %s/%s: %v", host, repository, err)
+		return
+	}
+	ct.set(auth, ttl)
+}
+
+// ForgetToken drops the cached token for the repository on the given
+// registry host, e.g., because the registry rejected it.
+func ForgetToken(host, repository string) {
+	tokens.Lock()
+	defer tokens.Unlock()
+	delete(tokens.m, tokenKey(host, scope(repository, "pull")))
+}
+
+// Authorization returns the Authorization header value to use for the
+// actions (e.g., "pull,push") on the repository on the given registry host,
+// or "" if the registry doesn't require auth. If a username and password are
+// given, they're used to get the token.
+func Authorization(host, repository, actions, username, password string) (string, error) {
+	auth, _, err := authorize(host, repository, actions, username, password)
+	return auth, err
+}
+
+// authorize returns the Authorization header value, as for Authorization,
+// and how long it lasts.
+func authorize(host, repository, actions, username, password string) (string, time.Duration, error) {
+	// Ping /v2/, determine the registry's auth scheme.
+	url := fmt.Sprintf("https://%s/v2/", host)
+	log.Println("  --> GET", url)
+	resp, err := Client.Get(url)
+	if err != nil {
+		return "", 0, err
+	}
+	resp.Body.Close()
+	log.Println("  <--", resp.StatusCode)
+	for k, v := range resp.Header {
+		for _, vv := range v {
+			log.Printf("  <-- %s: %s", k, vv)
+		}
+	}
+	if resp.StatusCode == http.StatusOK {
+		return "", defaultTokenTTL, nil // Registry doesn't require auth.
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return "", 0, fmt.Errorf("unexpected status code (%s): %d", url, resp.StatusCode)
+	}
+	chs := authchallenge.ResponseChallenges(resp)
+	if len(chs) == 0 {
+		return "", defaultTokenTTL, nil // Registry doesn't require auth.
+	}
+	switch strings.ToLower(chs[0].Scheme) {
+	case "bearer":
+	case "basic":
+		if username == "" {
+			return "", 0, errors.New("registry requires basic auth, but no credentials are configured")
+		}
+		return "Basic " + basic(username, password), defaultTokenTTL, nil
+	default:
+		return "", 0, fmt.Errorf("unsupported auth scheme: %s", chs[0].Scheme)
+	}
+
+	// Ping token endpoint, get a token.
+	service := chs[0].Parameters["service"]
+	realm := chs[0].Parameters["realm"]
+	url = fmt.Sprintf("%s?scope=%s&service=%s", realm, scope(repository, actions), service)
+	log.Println("  --> GET", url)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	if username != "" {
+		req.Header.Set("Authorization", "Basic "+basic(username, password))
+	}
+	resp, err = Client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	log.Println("  <--", resp.StatusCode)
+	for k, v := range resp.Header {
+		for _, vv := range v {
+			log.Printf("  <-- %s: %s", k, vv)
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("unexpected status code (%s): %d", url, resp.StatusCode)
+	}
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", 0, err
+	}
+	if tokenResp.Token == "" {
+		tokenResp.Token = tokenResp.AccessToken
+	}
+	ttl := defaultTokenTTL
+	if tokenResp.ExpiresIn > 0 {
+		ttl = time.Duration(tokenResp.ExpiresIn) * time.Second
+	}
+	return "Bearer " + tokenResp.Token, ttl, nil
+}
+
+func basic(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
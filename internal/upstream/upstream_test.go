@@ -0,0 +1,104 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeTokenServer returns a registry that requires bearer tokens, whose
+// token endpoint issues a new token for each request and counts them.
+func fakeTokenServer(t *testing.T, issued *int32) string {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/token":
+			n := atomic.AddInt32(issued, 1)
+			fmt.Fprintf(w, `{"token":"token-%d","expires_in":300}`, n)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	old := Client
+	Client = srv.Client()
+	t.Cleanup(func() { Client = old })
+	return strings.TrimPrefix(srv.URL, "https://")
+}
+
+func TestTokenReused(t *testing.T) {
+	var issued int32
+	host := fakeTokenServer(t, &issued)
+
+	// A manifest and then its blobs.
+	for i := 0; i < 3; i++ {
+		tok, err := Token(host, "foo/bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok != "token-1" {
+			t.Errorf("Token() = %q, want token-1", tok)
+		}
+	}
+	if _, err := Token(host, "foo/baz"); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&issued); got != 2 {
+		t.Errorf("issued %d tokens, want one per repository", got)
+	}
+
+	ForgetToken(host, "foo/bar")
+	if tok, err := Token(host, "foo/bar"); err != nil {
+		t.Fatal(err)
+	} else if tok != "token-3" {
+		t.Errorf("Token() after ForgetToken = %q, want token-3", tok)
+	}
+}
+
+func TestTokenRenewed(t *testing.T) {
+	var issued int32
+	host := fakeTokenServer(t, &issued)
+
+	if _, err := Token(host, "foo/bar"); err != nil {
+		t.Fatal(err)
+	}
+	tokens.Lock()
+	ct := tokens.m[tokenKey(host, scope("foo/bar", "pull"))]
+	tokens.Unlock()
+	ct.mu.Lock()
+	ct.renew = time.Now().Add(-time.Second)
+	ct.mu.Unlock()
+
+	// The token is still live, so it's used while it's renewed.
+	if tok, err := Token(host, "foo/bar"); err != nil {
+		t.Fatal(err)
+	} else if tok != "token-1" {
+		t.Errorf("Token() while renewing = %q, want token-1", tok)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		ct.mu.Lock()
+		done := !ct.refreshing
+		ct.mu.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("token wasn't renewed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if tok, err := Token(host, "foo/bar"); err != nil {
+		t.Fatal(err)
+	} else if tok != "token-2" {
+		t.Errorf("Token() after renewal = %q, want token-2", tok)
+	}
+}
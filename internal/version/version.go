@@ -0,0 +1,52 @@
+// Package version reports information about the running build.
+//
+// Commit and Date are set at build time, e.g.:
+//
+//	go build -ldflags "-X github.com/chainguard-dev/tlogistry/internal/version.Commit=$(git rev-parse HEAD)"
+//
+// If they're not set, they're populated from the VCS information stamped by
+// the Go toolchain, if available.
+package version
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+var (
+	// Commit is the git SHA the binary was built from.
+	Commit = ""
+	// Date is when the binary was built, in RFC 3339 format.
+	Date = ""
+)
+
+func init() {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			if Commit == "" {
+				Commit = s.Value
+			}
+		case "vcs.time":
+			if Date == "" {
+				Date = s.Value
+			}
+		}
+	}
+}
+
+// String returns a human-readable version string.
+func String() string {
+	c, d := Commit, Date
+	if c == "" {
+		c = "unknown"
+	}
+	if d == "" {
+		d = "unknown"
+	}
+	return fmt.Sprintf("%s (built %s)", c, d)
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	_ "embed"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -11,8 +15,19 @@ import (
 	"sync"
 	"time"
 
+	"github.com/chainguard-dev/tlogistry/internal/audit"
+	"github.com/chainguard-dev/tlogistry/internal/auth"
+	"github.com/chainguard-dev/tlogistry/internal/config"
+	"github.com/chainguard-dev/tlogistry/internal/digests"
+	"github.com/chainguard-dev/tlogistry/internal/elastic"
+	"github.com/chainguard-dev/tlogistry/internal/metrics"
+	"github.com/chainguard-dev/tlogistry/internal/policy"
+	"github.com/chainguard-dev/tlogistry/internal/referrers"
 	"github.com/chainguard-dev/tlogistry/internal/rekor"
-	authchallenge "github.com/docker/distribution/registry/client/auth/challenge"
+	"github.com/chainguard-dev/tlogistry/internal/scan"
+	"github.com/chainguard-dev/tlogistry/internal/syslog"
+	"github.com/chainguard-dev/tlogistry/internal/upstream"
+	"github.com/chainguard-dev/tlogistry/internal/version"
 	"github.com/gomarkdown/markdown"
 	"github.com/gomarkdown/markdown/html"
 	"github.com/gomarkdown/markdown/parser"
@@ -21,19 +36,110 @@ import (
 )
 
 func main() {
+	printVersion := flag.Bool("version", false, "print version information and exit")
+	flag.Parse()
+	if *printVersion {
+		fmt.Println("tlogistry", version.String())
+		return
+	}
+	log.Println("tlogistry", version.String())
+
 	var env struct {
 		Port int64 `envconfig:"PORT" default:"8080"`
+
+		// HelmCharts are OCI chart repositories whose pinned versions are
+		// served as a Helm HTTP repository under /charts.
+		HelmCharts   []string      `envconfig:"HELM_CHARTS"`
+		HelmIndexTTL time.Duration `envconfig:"HELM_INDEX_TTL" default:"5m"`
+
+		// Dashboard shows live statistics on the home page.
+		Dashboard bool `envconfig:"DASHBOARD"`
+
+		// AdminToken enables the admin API, and must be presented as a
+		// bearer token to use it.
+		AdminToken string `envconfig:"ADMIN_TOKEN"`
+
+		// RecordSignatures records a summary of the upstream image's
+		// cosign signatures in new pins.
+		RecordSignatures bool `envconfig:"RECORD_SIGNATURES"`
+		// RecordSBOM records the digest of the SBOM attached to the
+		// upstream image in new pins.
+		RecordSBOM bool `envconfig:"RECORD_SBOM"`
+		// VerifyChildren checks that the manifests of indexes served by
+		// tag exist upstream, and reports them in TLog-Child headers.
+		VerifyChildren bool `envconfig:"VERIFY_INDEX_CHILDREN"`
+
+		// RequestBudget is how long a registry request can take overall,
+		// and WriteBudget is how much of it has to be left to write a new
+		// pin before the response, rather than in the background.
+		RequestBudget time.Duration `envconfig:"REQUEST_BUDGET" default:"25s"`
+		WriteBudget   time.Duration `envconfig:"WRITE_BUDGET" default:"8s"`
+
+		// MismatchPolicy is what to do when a tag's digest doesn't match
+		// its pin, unless the vanity domain says otherwise.
+		MismatchPolicy string `envconfig:"MISMATCH_POLICY" default:"enforce"`
+
+		// MaxManifestSize is the largest manifest served, in bytes.
+		MaxManifestSize int64 `envconfig:"MAX_MANIFEST_SIZE" default:"4194304"`
 	}
 	if err := envconfig.Process("", &env); err != nil {
 		log.Fatalf("envconfig: %v", err)
 	}
 
+	showDashboard = env.Dashboard
+	recordSignatures = env.RecordSignatures
+	recordSBOM = env.RecordSBOM
+	verifyChildren = env.VerifyChildren
+	requestBudget, writeBudget = env.RequestBudget, env.WriteBudget
+	if env.MaxManifestSize <= 0 {
+		log.Fatalf("MAX_MANIFEST_SIZE must be positive, got %d", env.MaxManifestSize)
+	}
+	maxManifestSize = env.MaxManifestSize
+	switch env.MismatchPolicy {
+	case config.Enforce, config.Warn, config.ServePinned:
+		defaultMismatchPolicy = env.MismatchPolicy
+	default:
+		log.Fatalf("MISMATCH_POLICY must be %q, %q or %q, got %q", config.Enforce, config.Warn, config.ServePinned, env.MismatchPolicy)
+	}
 	http.HandleFunc("/", handleHome)
 	http.HandleFunc("/style.css", handleStyle)
-	http.HandleFunc("/v2/", handler)
+	http.HandleFunc("/healthz", handleHealthz)
+	http.Handle("/metrics", metrics.Handler())
+	http.HandleFunc("/verify", handleVerify)
+	http.HandleFunc("/api/v1/whohas", handleWhoHas)
+	http.HandleFunc("/api/v1/tags-for-digest/", handleTagsForDigest)
+	http.Handle("/v2/", auth.Middleware(http.HandlerFunc(handler), func(w http.ResponseWriter) {
+		serveError(w, regError{status: http.StatusUnauthorized, Code: "UNAUTHORIZED", Message: "authentication required"})
+	}))
+	if env.AdminToken != "" {
+		http.Handle("/admin/", adminHandler(env.AdminToken))
+	}
+	if elastic.Enabled() {
+		elastic.Start()
+	}
+	if syslog.Enabled() {
+		syslog.Start()
+	}
+	if len(env.HelmCharts) > 0 {
+		c, err := newCharts(env.HelmCharts, env.HelmIndexTTL)
+		if err != nil {
+			log.Fatalf("charts: %v", err)
+		}
+		http.Handle("/charts/", c)
+	}
 
 	log.Printf("Listening on port %d", env.Port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", env.Port), nil))
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", env.Port), withVersion(withCompression(http.DefaultServeMux))))
+}
+
+// withVersion reports the running build in a header on every response.
+func withVersion(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if version.Commit != "" {
+			w.Header().Set("TLog-Version", version.Commit)
+		}
+		h.ServeHTTP(w, r)
+	})
 }
 
 //go:embed README.md
@@ -53,12 +159,36 @@ func handleHome(w http.ResponseWriter, _ *http.Request) {
 				Title: "tlogistry.dev",
 				Flags: html.CommonFlags | html.CompletePage | html.HrefTargetBlank,
 			}))
+		// Leave the page open, so more content can be added below the README.
+		if i := bytes.LastIndex(readmeHTML, []byte("</body>")); i >= 0 {
+			readmeHTML = readmeHTML[:i]
+		}
 	})
-	if _, err := w.Write(readmeHTML); err != nil {
+	var buf bytes.Buffer
+	buf.Write(readmeHTML)
+	buf.WriteString(verifyForm)
+	if showDashboard {
+		if err := writeDashboard(&buf); err != nil {
+			log.Printf("!!! ERROR RENDERING DASHBOARD: %v", err)
+		}
+	}
+	fmt.Fprintf(&buf, "<hr><p><small>Version: <code>%s</code></small></p>\n</body>\n</html>\n", version.String())
+	if _, err := w.Write(buf.Bytes()); err != nil {
 		log.Printf("!!! ERROR WRITING HTML: %v", err)
 	}
 }
 
+func handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{
+		"status": "ok",
+		"commit": version.Commit,
+		"date":   version.Date,
+	}); err != nil {
+		log.Printf("!!! ERROR WRITING HEALTHZ: %v", err)
+	}
+}
+
 func handleStyle(w http.ResponseWriter, _ *http.Request) {
 	w.Header().Set("Content-Type", "text/css")
 	if _, err := w.Write(style); err != nil {
@@ -82,24 +212,64 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func proxy(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+var requestBudget, writeBudget time.Duration
 
-	parts := strings.Split(r.URL.Path, "/")
+// defaultMismatchPolicy applies to requests that aren't to a vanity domain
+// with its own policy.
+var defaultMismatchPolicy = config.Enforce
+
+func proxy(w http.ResponseWriter, r *http.Request) {
+	// Everything has to fit in the request's budget, or the client might
+	// time out.
+	ctx, cancel := context.WithTimeout(r.Context(), requestBudget)
+	defer cancel()
 
 	// /v2/ubuntu/manifests/latest -> ubuntu
 	// /v2/example.biz/foo/bar/manifests/latest -> example.biz/foo/bar
-	repostr := strings.Join(parts[2:len(parts)-2], "/")
+	rt, err := parseRoute(r.URL.Path)
+	if err != nil {
+		serveError(w, regError{status: http.StatusBadRequest, Code: "NAME_INVALID", Message: fmt.Sprintf("parsing request path: %v", err)})
+		return
+	}
+	repostr := rt.repo
+
+	// Requests to vanity domains are relative to the domain's registry.
+	mismatchPolicy := defaultMismatchPolicy
+	domain, err := vanityDomain(ctx, r.Host)
+	if err != nil {
+		serveError(w, regError{status: http.StatusMisdirectedRequest, Code: "DENIED", Message: err.Error()})
+		return
+	}
+	if domain != nil {
+		repostr = strings.TrimSuffix(domain.Registry, "/") + "/" + repostr
+		if domain.MismatchPolicy != "" {
+			mismatchPolicy = domain.MismatchPolicy
+		}
+	}
+
 	repo, err := name.NewRepository(repostr)
 	if err != nil {
 		serveError(w, regError{status: http.StatusBadRequest, Code: "NAME_INVALID", Message: fmt.Sprintf("parsing repository name: %v", err)})
 		return
 	}
 
-	url := fmt.Sprintf("https://%s/v2/%s/%s", repo.RegistryStr(), repo.RepositoryStr(), strings.Join(parts[len(parts)-2:], "/"))
+	host := upstream.Route(repo.RegistryStr())
+	if host != repo.RegistryStr() {
+		w.Header().Set("TLog-Upstream", host)
+	}
+	url := fmt.Sprintf("https://%s/v2/%s/%s", host, repo.RepositoryStr(), rt.suffix())
 	log.Println("-->", r.Method, r.URL)
-	req, _ := http.NewRequest(r.Method, url, nil)
+	req, _ := http.NewRequestWithContext(ctx, r.Method, url, nil)
 	for k, v := range r.Header {
+		if k == "User-Agent" {
+			continue // Upstreams see tlogistry's User-Agent.
+		}
+		if k == "Accept" && rt.kind == kindManifests {
+			continue // Normalized below.
+		}
+		if k == "Accept-Encoding" {
+			continue // Negotiated with the client by withCompression.
+		}
 		for _, vv := range v {
 			req.Header.Add(k, vv)
 			if k == "Authorization" {
@@ -108,18 +278,26 @@ func proxy(w http.ResponseWriter, r *http.Request) {
 			log.Printf("--> %s: %s", k, vv)
 		}
 	}
+	if ua := r.Header.Get("User-Agent"); ua != "" {
+		req.Header.Set("X-Forwarded-User-Agent", ua)
+	}
+	req.Header.Add("Via", fmt.Sprintf("%d.%d tlogistry", r.ProtoMajor, r.ProtoMinor))
+	var accept string
+	if rt.kind == kindManifests {
+		accept = manifestAccept(r.Header.Values("Accept"))
+		req.Header.Set("Accept", accept)
+		log.Printf("--> Accept: %s", accept)
+	}
 
-	isManifestTagRequest := parts[len(parts)-2] == "manifests" &&
-		!strings.HasPrefix(parts[len(parts)-1], "sha256:")
+	isManifestTagRequest := rt.kind == kindManifests && !rt.isDigest()
 
 	// If this is a request for manifest by tag, check Rekor to see if we have a digest for it.
 	var tag name.Tag
 	var wantDigest string
 	var info *rekor.Info
 	if isManifestTagRequest {
-		tagstr := parts[len(parts)-1]
 		var err error
-		tag, err = name.NewTag(fmt.Sprintf("%s:%s", repo.String(), tagstr))
+		tag, err = name.NewTag(fmt.Sprintf("%s:%s", repo.String(), rt.ref))
 		if err != nil {
 			serveError(w, regError{status: http.StatusBadRequest, Code: "NAME_INVALID", Message: fmt.Sprintf("parsing tag: %v", err)})
 			return
@@ -130,6 +308,13 @@ func proxy(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		log.Println("=== REKOR: found digest for tag", tag, wantDigest)
+
+		// Serve the Sigstore bundle for the pin instead of the manifest.
+		if r.URL.Query().Get("bundle") == "true" {
+			serveBundle(w, tag, info)
+			return
+		}
+		audit.Pulled(repo.String())
 	}
 
 	// If the request is coming in without auth, get some auth.
@@ -137,29 +322,175 @@ func proxy(w http.ResponseWriter, r *http.Request) {
 	// It's unlikely the request comes in with auth already attached, since
 	// that would have required /v2 to point to /token and for /token to
 	// have generated some creds.
+	tokened := false
 	if req.Header.Get("Authorization") == "" {
 		log.Println("  Getting token...")
-		t, err := getToken(repo)
+		t, err := upstream.Token(host, repo.RepositoryStr())
 		if err != nil {
 			serveError(w, newRegError(fmt.Errorf("getting token: %v", err)))
 			return
 		}
-		req.Header.Set("Authorization", "Bearer "+t)
+		if t != "" {
+			req.Header.Set("Authorization", "Bearer "+t)
+			tokened = true
+		}
 	}
 
-	resp, err := http.DefaultTransport.RoundTrip(req) // Transport doesn't follow redirects.
+	resp, err := upstream.Transport.RoundTrip(req) // Transport doesn't follow redirects.
 	if err != nil {
 		serveError(w, newRegError(fmt.Errorf("fetching %q: %v", url, err)))
 		return
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized && tokened {
+		upstream.ForgetToken(host, repo.RepositoryStr()) // It might have been revoked.
+	}
 
-	gotDigest := resp.Header.Get("Docker-Content-Digest")
-	if wantDigest != "" && gotDigest != wantDigest {
-		serveError(w, digestMismatch(tag.String(), gotDigest, wantDigest))
+	if r.Method == http.MethodGet && rt.kind != kindBlobs {
+		if err := decodeBody(resp); err != nil {
+			serveError(w, newRegError(fmt.Errorf("fetching %q: %v", url, err)))
+			return
+		}
+	}
+	if rt.kind == kindManifests && resp.StatusCode == http.StatusOK && resp.ContentLength > maxManifestSize {
+		serveError(w, manifestTooLarge(url))
 		return
 	}
 
+	gotDigest := strings.TrimSpace(resp.Header.Get("Docker-Content-Digest"))
+	if rt.kind == kindManifests && resp.StatusCode == http.StatusOK && !digests.Valid(gotDigest) {
+		// Some registries don't report the digest, but pins and clients
+		// like containerd need it.
+		if gotDigest, err = manifestDigest(req, resp, digests.Canonical); errors.Is(err, errTooLarge) {
+			serveError(w, manifestTooLarge(url))
+			return
+		} else if err != nil {
+			serveError(w, newRegError(fmt.Errorf("computing digest of %q: %v", url, err)))
+			return
+		}
+		resp.Header.Set("Docker-Content-Digest", gotDigest)
+	}
+	mismatch := wantDigest != "" && gotDigest != wantDigest
+	if alg := digests.Algorithm(wantDigest); mismatch && gotDigest != "" && digests.Algorithm(gotDigest) != alg {
+		// The registry reports the digest with another algorithm than the
+		// pin's, so compare the manifest's digest with the pin's.
+		d, err := manifestDigest(req, resp, alg)
+		if err != nil {
+			serveError(w, newRegError(fmt.Errorf("computing %s digest of %q: %v", alg, url, err)))
+			return
+		}
+		mismatch = d != wantDigest
+	}
+	if mismatch && gotDigest != "" {
+		// The client might not accept the pinned index's type, and have
+		// been served one of its manifests instead.
+		in, err := inIndex(ctx, repo, wantDigest, gotDigest)
+		if err != nil {
+			log.Println("!!! ERROR CHECKING PINNED INDEX:", err)
+		}
+		mismatch = !in
+	}
+	if mismatch {
+		audit.Record(audit.Event{
+			Kind:   audit.Mismatch,
+			Repo:   repo.String(),
+			Tag:    tag.String(),
+			Digest: gotDigest,
+			Want:   wantDigest,
+			UUID:   info.UUID,
+		})
+		switch mismatchPolicy {
+		case config.Warn:
+			log.Printf("=== WARNING: serving mismatched digest for %s; got %q, want %q", tag, gotDigest, wantDigest)
+		case config.ServePinned:
+			log.Printf("=== WARNING: serving pinned digest for %s; got %q, want %q", tag, gotDigest, wantDigest)
+			presp, err := fetchPinned(req, fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, repo.RepositoryStr(), wantDigest), wantDigest)
+			if err != nil {
+				serveError(w, newRegError(fmt.Errorf("fetching pinned manifest for tag %q: %v", tag, err)))
+				return
+			}
+			resp.Body.Close()
+			resp, gotDigest = presp, wantDigest
+			defer resp.Body.Close()
+		default:
+			serveError(w, digestMismatch(r.Host+"/"+rt.repo, tag, gotDigest, wantDigest, info))
+			return
+		}
+		w.Header().Set("TLog-Mismatch", wantDigest)
+	}
+
+	// Scan never-before-seen digests before serving them.
+	var scanned *scan.Summary
+	if scan.Enabled() && isManifestTagRequest && gotDigest != "" && wantDigest == "" {
+		scanned, err = scan.Scan(ctx, repo.Digest(gotDigest))
+		switch {
+		case err != nil && scan.Enforced():
+			serveError(w, newRegError(err))
+			return
+		case err != nil:
+			log.Println("!!! ERROR SCANNING:", err)
+		case scanned.Failed && scan.Enforced():
+			serveError(w, regError{status: http.StatusForbidden, Code: "DENIED", Message: fmt.Sprintf("%s@%s has vulnerabilities at or above %s: %s", repo, gotDigest, scanned.Threshold, scanned)})
+			return
+		case scanned.Failed:
+			log.Printf("=== WARNING: serving %s@%s with vulnerabilities: %s", repo, gotDigest, scanned)
+			w.Header().Set("TLog-Scan", scanned.String())
+		}
+	}
+
+	if policy.Enabled() && rt.kind == kindManifests && gotDigest != "" {
+		in := policy.Input{
+			Method:    r.Method,
+			Repo:      repo.String(),
+			Digest:    gotDigest,
+			Principal: auth.Principal(ctx),
+			Pinned:    wantDigest != "",
+		}
+		if isManifestTagRequest {
+			in.Tag = tag.String()
+		}
+		if info != nil {
+			in.PinAge = int64(time.Since(info.IntegratedTime).Seconds())
+			in.Identity = info.Identity
+		}
+		if mismatch {
+			in.Mismatch = wantDigest
+		}
+		if scanned != nil {
+			in.Scan = scanned
+		}
+		d, err := policy.Decide(ctx, in)
+		if err != nil {
+			serveError(w, newRegError(err))
+			return
+		}
+		if !d.Allow {
+			msg := fmt.Sprintf("denied by policy: %s@%s", repo, gotDigest)
+			if d.Reason != "" {
+				msg += ": " + d.Reason
+			}
+			audit.Record(audit.Event{
+				Kind:   audit.Denied,
+				Repo:   repo.String(),
+				Tag:    in.Tag,
+				Digest: gotDigest,
+				Detail: d.Reason,
+			})
+			serveError(w, regError{status: http.StatusForbidden, Code: "DENIED", Message: msg})
+			return
+		}
+	}
+
+	if verifyChildren && isManifestTagRequest && r.Method == http.MethodGet && resp.StatusCode == http.StatusOK && indexMediaTypes[mediaType(resp.Header.Get("Content-Type"))] {
+		children, err := childStatuses(req, resp)
+		if err != nil {
+			log.Println("!!! ERROR CHECKING INDEX CHILDREN:", err)
+		}
+		for _, c := range children {
+			w.Header().Add("TLog-Child", c)
+		}
+	}
+
 	log.Println("<--", resp.StatusCode)
 	for k, v := range resp.Header {
 		for _, vv := range v {
@@ -171,9 +502,85 @@ func proxy(w http.ResponseWriter, r *http.Request) {
 	if isManifestTagRequest && // If this is a request for manifest by tag,
 		gotDigest != "" && // and we have the digest now,
 		wantDigest == "" { // and we didn't have one before --> record it in Rekor.
-		log.Println("=== REKOR: writing digest for tag", tag, gotDigest)
-		if info, err = rekor.Put(ctx, tag, gotDigest); err != nil {
-			log.Println("!!! ERROR WRITING TO REKOR:", err)
+		pinDigest := gotDigest
+		if !acceptsIndexes(accept) && !indexMediaTypes[mediaType(resp.Header.Get("Content-Type"))] {
+			// The client doesn't accept all index types, so pin the index
+			// the tag points to, if it's one, rather than the manifest the
+			// client got.
+			if d, err := resolve(ctx, tag); err != nil {
+				log.Println("!!! ERROR RESOLVING TAG:", err)
+			} else if d != gotDigest {
+				if in, err := inIndex(ctx, repo, d, gotDigest); err != nil {
+					log.Println("!!! ERROR CHECKING INDEX:", err)
+				} else if in {
+					pinDigest = d
+				}
+			}
+		}
+		log.Println("=== REKOR: writing digest for tag", tag, pinDigest)
+		extra := map[string]interface{}{}
+		if p := auth.Principal(ctx); p != "" {
+			extra["principal"] = p // Who caused this tag to be pinned.
+		}
+		if recordSignatures {
+			// The supply-chain state of the image when it was first pulled.
+			if sigs, err := signatures(ctx, repo, pinDigest); err != nil {
+				log.Println("!!! ERROR CHECKING SIGNATURES:", err)
+			} else if sigs != nil {
+				extra["signatures"] = sigs
+			}
+		}
+		if scanned != nil {
+			extra["scan"] = scanned
+		}
+		if recordSBOM {
+			if s, err := sbom(ctx, repo, pinDigest); err != nil {
+				log.Println("!!! ERROR CHECKING SBOM:", err)
+			} else if s != nil {
+				extra["sbom"] = s
+			}
+		}
+		subject := referrers.Descriptor{
+			MediaType: resp.Header.Get("Content-Type"),
+			Digest:    gotDigest,
+			Size:      resp.ContentLength,
+		}
+		pinned := func(info *rekor.Info) {
+			audit.Record(audit.Event{
+				Kind:   audit.Pinned,
+				Repo:   repo.String(),
+				Tag:    tag.String(),
+				Digest: pinDigest,
+				UUID:   info.UUID,
+			})
+			// The index's descriptor isn't at hand if the client got one of
+			// its manifests.
+			if referrers.Enabled() && pinDigest == gotDigest {
+				go publishReferrer(tag, subject, info)
+			}
+		}
+		deadline, _ := ctx.Deadline()
+		switch {
+		case rekor.Queued(tag):
+			log.Println("=== REKOR: write for tag is already queued", tag)
+		case time.Until(deadline) < writeBudget:
+			// Writing now could make the client time out, so serve the
+			// manifest, and write the entry in the background.
+			log.Println("=== REKOR: deferring write for tag", tag)
+			if !rekor.PutAsync(tag, pinDigest, extra, func(info *rekor.Info, err error) {
+				if err == nil {
+					pinned(info)
+				}
+			}) {
+				log.Println("!!! ERROR WRITING TO REKOR: write queue is full")
+			}
+			w.Header().Set("TLog-Pin-Deferred", "true")
+		default:
+			if info, err = rekor.Put(ctx, tag, pinDigest, extra); err != nil {
+				log.Println("!!! ERROR WRITING TO REKOR:", err)
+			} else {
+				pinned(info)
+			}
 		}
 		// This request made us write an entry for the first time.
 		w.Header().Set("TLog-First-Seen", "true")
@@ -185,67 +592,79 @@ func proxy(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("TLog-IntegratedTime", info.IntegratedTime.Format(time.RFC3339))
 	}
 	w.WriteHeader(resp.StatusCode)
-	if parts[len(parts)-2] != "blobs" { // Never proxy blobs.
+	switch {
+	case rt.kind == kindBlobs: // Never proxy blobs.
+	case rt.kind == kindManifests && r.Method == http.MethodGet && resp.StatusCode == http.StatusOK:
+		if err := copyManifest(w, resp.Body, gotDigest); err != nil {
+			// The headers are already sent, so abort the response rather
+			// than let the client think it got the whole manifest.
+			log.Printf("!!! ERROR SERVING MANIFEST %q: %v", url, err)
+			panic(http.ErrAbortHandler)
+		}
+	default:
 		if _, err := io.Copy(w, resp.Body); err != nil {
 			log.Println("!!! ERROR COPYING RESPONSE BODY:", err)
 		}
 	}
 }
 
-func getToken(repo name.Repository) (string, error) {
-	// Ping /v2/, determine the registry's auth scheme.
-	url := fmt.Sprintf("https://%s/v2/", repo.RegistryStr())
-	log.Println("  --> GET", url)
-	resp, err := http.Get(url)
+// manifestTooLarge is the error for a manifest over maxManifestSize.
+func manifestTooLarge(url string) regError {
+	return regError{status: http.StatusBadGateway, Code: "MANIFEST_INVALID", Message: fmt.Sprintf("manifest %q exceeds %d bytes", url, maxManifestSize)}
+}
+
+// copyManifest copies the manifest to w, hashing it as it goes, and fails if
+// it exceeds maxManifestSize or doesn't match the digest.
+func copyManifest(w io.Writer, r io.Reader, digest string) error {
+	v, err := digests.NewVerifier(digest)
 	if err != nil {
-		return "", err
-	}
-	log.Println("  <--", resp.StatusCode)
-	for k, v := range resp.Header {
-		for _, vv := range v {
-			log.Printf("  <-- %s: %s", k, vv)
-		}
-	}
-	if resp.StatusCode == http.StatusOK {
-		return "", nil // Registry doesn't require auth.
-	}
-	if resp.StatusCode != http.StatusUnauthorized {
-		return "", fmt.Errorf("unexpected status code (%s): %d", url, resp.StatusCode)
+		return err
 	}
-	chs := authchallenge.ResponseChallenges(resp)
-	if len(chs) == 0 {
-		return "", nil // Registry doesn't require auth.
-	}
-	if strings.ToLower(chs[0].Scheme) != "bearer" {
-		return "", fmt.Errorf("unsupported auth scheme: %s", chs[0].Scheme)
+	n, err := io.Copy(io.MultiWriter(w, v), io.LimitReader(r, maxManifestSize+1))
+	switch {
+	case err != nil:
+		return err
+	case n > maxManifestSize:
+		return errTooLarge
 	}
+	return v.Verify()
+}
 
-	// Ping token endpoint, get a token.
-	service := chs[0].Parameters["service"]
-	realm := chs[0].Parameters["realm"]
-	url = fmt.Sprintf("%s?scope=repository:%s:pull&service=%s", realm, repo.RepositoryStr(), service)
-	log.Println("  --> GET", url)
-	resp, err = http.Get(url)
+// publishReferrer publishes the pin's bundle as a referrer of the pinned
+// manifest, without holding up the response.
+func publishReferrer(tag name.Tag, subject referrers.Descriptor, info *rekor.Info) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	b, err := info.Bundle()
 	if err != nil {
-		return "", err
+		log.Println("!!! ERROR PUBLISHING REFERRER:", err)
+		return
 	}
-	log.Println("  <--", resp.StatusCode)
-	for k, v := range resp.Header {
-		for _, vv := range v {
-			log.Printf("  <-- %s: %s", k, vv)
-		}
+	bb, err := json.Marshal(b)
+	if err != nil {
+		log.Println("!!! ERROR PUBLISHING REFERRER:", err)
+		return
 	}
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("unexpected status code (%s): %d", url, resp.StatusCode)
+	if _, err := referrers.Publish(ctx, subject, tag, info.UUID, bb, rekor.BundleMediaType); err != nil {
+		log.Println("!!! ERROR PUBLISHING REFERRER:", err)
 	}
-	defer resp.Body.Close()
-	var tokenResp struct {
-		Token string `json:"token"`
+}
+
+func serveBundle(w http.ResponseWriter, tag name.Tag, info *rekor.Info) {
+	if info == nil {
+		serveError(w, regError{status: http.StatusNotFound, Code: "MANIFEST_UNKNOWN", Message: fmt.Sprintf("tag %q is not pinned", tag)})
+		return
+	}
+	b, err := info.Bundle()
+	if err != nil {
+		serveError(w, newRegError(fmt.Errorf("generating bundle for %q: %v", tag, err)))
+		return
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
-		return "", err
+	w.Header().Set("Content-Type", rekor.BundleMediaType)
+	w.Header().Set("TLog-UUID", info.UUID)
+	if err := json.NewEncoder(w).Encode(b); err != nil {
+		log.Println("!!! ERROR WRITING BUNDLE:", err)
 	}
-	return tokenResp.Token, nil
 }
 
 func serveError(w http.ResponseWriter, re regError) {
@@ -257,22 +676,91 @@ func serveError(w http.ResponseWriter, re regError) {
 	}
 }
 
+func serveJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("!!! ERROR WRITING JSON: %v", err)
+	}
+}
+
 type resp struct {
 	Errors []regError `json:"errors"`
 }
 
 type regError struct {
 	status  int
-	Code    string `json:"code"`
-	Message string `json:"message"`
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Detail  interface{} `json:"detail,omitempty"`
 }
 
-func digestMismatch(tag, got, want string) regError {
+// mismatchReport is the detail of a TAG_INVALID error, reporting the pin
+// the tag was checked against and what the client can do about it.
+type mismatchReport struct {
+	Tag      string    `json:"tag"`
+	Got      string    `json:"got"`
+	Pinned   string    `json:"pinned"`
+	PinnedAt time.Time `json:"pinnedAt"`
+	UUID     string    `json:"uuid"`
+	LogIndex int64     `json:"logIndex"`
+	EntryURL string    `json:"entryURL"`
+	Actions  []string  `json:"actions"`
+}
+
+// digestMismatch reports that the tag's manifest has digest got, but the tag
+// is pinned to want by the entry in info. image is the repository as the
+// client pulled it.
+func digestMismatch(image string, tag name.Tag, got, want string, info *rekor.Info) regError {
 	return regError{
 		status:  http.StatusBadRequest,
 		Code:    "TAG_INVALID",
 		Message: fmt.Sprintf("tag %q mismatch; got %q, want %q", tag, got, want),
+		Detail: mismatchReport{
+			Tag:      tag.String(),
+			Got:      got,
+			Pinned:   want,
+			PinnedAt: info.IntegratedTime.UTC(),
+			UUID:     info.UUID,
+			LogIndex: info.LogIndex,
+			EntryURL: fmt.Sprintf("%s/api/v1/log/entries/%s", rekor.URL(), info.UUID),
+			Actions: []string{
+				fmt.Sprintf("Pull the pinned digest instead: %s@%s", image, want),
+				fmt.Sprintf("If %s was moved on purpose, ask this registry's operator to supersede the pin.", tag),
+				fmt.Sprintf("Check the pin yourself: rekor-cli verify --rekor_server %s --uuid %s", rekor.URL(), info.UUID),
+			},
+		},
+	}
+}
+
+// fetchPinned fetches the pinned manifest with the digest from url, with
+// req's headers, to serve in place of the tag's current one. The manifest is
+// checked against the digest, so the upstream can't serve anything else.
+func fetchPinned(req *http.Request, url, digest string) (*http.Response, error) {
+	get, err := http.NewRequestWithContext(req.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	get.Header = req.Header.Clone()
+	resp, err := upstream.Transport.RoundTrip(get)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code (%s): %d", url, resp.StatusCode)
+	}
+	b, err := readVerified(resp.Body, digest, maxManifestSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest %s: %w", digest, err)
+	}
+	resp.Header.Set("Docker-Content-Digest", digest)
+	resp.Header.Set("Content-Length", fmt.Sprint(len(b)))
+	resp.ContentLength = int64(len(b))
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	if req.Method == http.MethodHead {
+		resp.Body = http.NoBody
 	}
+	return resp, nil
 }
 
 func newRegError(err error) regError {
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/chainguard-dev/tlogistry/internal/audit"
+	"github.com/chainguard-dev/tlogistry/internal/digests"
+	"github.com/chainguard-dev/tlogistry/internal/rekor"
+	"github.com/chainguard-dev/tlogistry/internal/upstream"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// maxBulkPins is the most images that can be pinned in one request.
+const maxBulkPins = 1000
+
+// manifestMediaTypes are the manifest types accepted when resolving tags.
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+type pinResult struct {
+	Image     string `json:"image"`
+	Digest    string `json:"digest,omitempty"`
+	UUID      string `json:"uuid,omitempty"`
+	FirstSeen bool   `json:"firstSeen,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// handlePins pins each of the requested images' tags, as if they'd been
+// pulled, signing all the new entries under one Fulcio cert.
+//
+//	POST /admin/pins {"images": ["alpine:3.16.0", ...]}
+func handlePins(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		serveError(w, regError{status: http.StatusMethodNotAllowed, Code: "UNSUPPORTED", Message: "use POST"})
+		return
+	}
+	ctx := r.Context()
+	var body struct {
+		Images []string `json:"images"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+		serveError(w, regError{status: http.StatusBadRequest, Code: "UNSUPPORTED", Message: fmt.Sprintf("decoding request: %v", err)})
+		return
+	}
+	if len(body.Images) > maxBulkPins {
+		serveError(w, regError{status: http.StatusBadRequest, Code: "UNSUPPORTED", Message: fmt.Sprintf("at most %d images can be pinned at once", maxBulkPins)})
+		return
+	}
+
+	results := make([]pinResult, len(body.Images))
+	var pins []rekor.Pin
+	var pending []int // Indexes of results for pins.
+	for i, img := range body.Images {
+		res := &results[i]
+		res.Image = img
+		tag, err := name.NewTag(img)
+		if err != nil {
+			res.Error = fmt.Sprintf("parsing tag: %v", err)
+			continue
+		}
+		want, info, err := rekor.Get(ctx, tag)
+		if err != nil {
+			res.Error = fmt.Sprintf("looking up digest: %v", err)
+			continue
+		}
+		if want != "" {
+			res.Digest, res.UUID = want, info.UUID
+			continue
+		}
+		got, err := resolve(ctx, tag)
+		if err != nil {
+			res.Error = fmt.Sprintf("resolving tag: %v", err)
+			continue
+		}
+		res.Digest = got
+		pins = append(pins, rekor.Pin{Tag: tag, Digest: got, Extra: map[string]interface{}{"principal": "admin"}})
+		pending = append(pending, i)
+	}
+
+	log.Printf("=== REKOR: writing %d digests in bulk", len(pins))
+	infos, errs := rekor.PutBatch(ctx, pins)
+	for j, i := range pending {
+		res := &results[i]
+		if errs[j] != nil {
+			log.Println("!!! ERROR WRITING TO REKOR:", errs[j])
+			res.Error = fmt.Sprintf("writing to Rekor: %v", errs[j])
+			continue
+		}
+		res.UUID, res.FirstSeen = infos[j].UUID, true
+		audit.Record(audit.Event{
+			Kind:   audit.Pinned,
+			Repo:   pins[j].Tag.Context().String(),
+			Tag:    pins[j].Tag.String(),
+			Digest: pins[j].Digest,
+			UUID:   infos[j].UUID,
+		})
+	}
+	serveJSON(w, results)
+}
+
+// resolve returns the digest the upstream registry serves for the tag.
+func resolve(ctx context.Context, tag name.Tag) (string, error) {
+	repo := tag.Context()
+	host := upstream.Route(repo.RegistryStr())
+	t, err := upstream.Token(host, repo.RepositoryStr())
+	if err != nil {
+		return "", fmt.Errorf("getting token: %w", err)
+	}
+	url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, repo.RepositoryStr(), tag.TagStr())
+	log.Println("  --> HEAD", url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return "", err
+	}
+	if t != "" {
+		req.Header.Set("Authorization", "Bearer "+t)
+	}
+	for _, mt := range manifestMediaTypes {
+		req.Header.Add("Accept", mt)
+	}
+	resp, err := upstream.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	log.Println("  <--", resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code (%s): %d", url, resp.StatusCode)
+	}
+	if digest := strings.TrimSpace(resp.Header.Get("Docker-Content-Digest")); digests.Valid(digest) {
+		return digest, nil
+	}
+	return manifestDigest(req, resp, digests.Canonical)
+}
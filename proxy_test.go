@@ -0,0 +1,585 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/tlogistry/internal/auth"
+	"github.com/chainguard-dev/tlogistry/internal/config"
+	"github.com/chainguard-dev/tlogistry/internal/digests"
+	"github.com/chainguard-dev/tlogistry/internal/rekor"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+)
+
+// The integration tests run the proxy against a fake upstream registry, and
+// a fake Fulcio and Rekor. Since tlogistry reads its configuration from the
+// environment when its packages are initialized, TestMain reruns the test
+// binary with an environment pointing at the fakes.
+const (
+	testIdentity = "tlogistry@example.com"
+	testIssuer   = "https://issuer.example.com"
+	testKeyID    = "ci"
+	testKey      = "hunter2"
+)
+
+var (
+	sigstore         *fakeSigstore
+	upstreamRegistry *fakeUpstream
+	registryHost     string // The fake upstream registry, e.g., 127.0.0.1:1234.
+	registryClient   *http.Client
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv("TLOGISTRY_TEST_DIR") == "" {
+		os.Exit(rerun())
+	}
+	os.Exit(run(m))
+}
+
+// rerun reruns the test binary with the environment for the fakes, and
+// hands it a listener for the fake Fulcio and Rekor, since their URL has to
+// be known before it starts.
+func rerun() int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		log.Fatal(err)
+	}
+	dir, err := os.MkdirTemp("", "tlogistry-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	url := "http://" + l.Addr().String()
+	keyHash := sha256.Sum256([]byte(testKey))
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"TLOGISTRY_TEST_DIR="+dir,
+		"REKOR_URL="+url,
+		"FULCIO_URL="+url,
+		"SIGSTORE_ROOT_FILE="+filepath.Join(dir, "root.pem"),
+		"OIDC_ISSUER="+testIssuer,
+		"IDENTITIES="+testIdentity,
+		"IDENTITY_PROVIDER=file",
+		"IDENTITY_TOKEN_FILE="+filepath.Join(dir, "token"),
+		"AUTH_API_KEYS="+testKeyID+":"+hex.EncodeToString(keyHash[:]),
+	)
+	cmd.ExtraFiles = []*os.File{f} // fd 3
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			return exit.ExitCode()
+		}
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// run starts the fakes and runs the tests.
+func run(m *testing.M) int {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	dir := os.Getenv("TLOGISTRY_TEST_DIR")
+
+	l, err := net.FileListener(os.NewFile(3, "sigstore"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	sigstore, err = newFakeSigstore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := httptest.NewUnstartedServer(sigstore)
+	s.Listener.Close()
+	s.Listener = l
+	s.Start()
+	defer s.Close()
+	if err := os.WriteFile(filepath.Join(dir, "root.pem"), sigstore.rootPEM, 0o600); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "token"), []byte(idToken(testIssuer, testIdentity)), 0o600); err != nil {
+		log.Fatal(err)
+	}
+
+	upstreamRegistry = &fakeUpstream{registry: registry.New(registry.Logger(log.New(io.Discard, "", 0)))}
+	reg := httptest.NewTLSServer(upstreamRegistry)
+	defer reg.Close()
+	registryHost = reg.Listener.Addr().String()
+	registryClient = reg.Client()
+	// Upstream requests have to trust the registry's cert.
+	http.DefaultTransport.(*http.Transport).TLSClientConfig = registryClient.Transport.(*http.Transport).TLSClientConfig
+
+	requestBudget, writeBudget = time.Minute, time.Second
+	return m.Run()
+}
+
+// idToken returns an unsigned ID token for the email, which the fake Fulcio
+// accepts.
+func idToken(issuer, email string) string {
+	enc := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	return enc(map[string]string{"alg": "none"}) + "." +
+		enc(map[string]string{"iss": issuer, "sub": email, "email": email, "aud": "sigstore"}) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte("sig"))
+}
+
+var nonce int64
+
+const (
+	ociManifest = "application/vnd.oci.image.manifest.v1+json"
+	ociIndex    = "application/vnd.oci.image.index.v1+json"
+)
+
+// push pushes a new image to the fake registry as repo:tag, and returns its
+// digest.
+func push(t *testing.T, repo, tag string) string {
+	t.Helper()
+	return put(t, repo, tag, ociManifest, image(t, repo))
+}
+
+// pushIndex pushes a new index of two images to the fake registry as
+// repo:tag, and returns its digest and the digests of its images.
+func pushIndex(t *testing.T, repo, tag string) (string, []string) {
+	t.Helper()
+	var manifests []interface{}
+	var digests []string
+	for _, arch := range []string{"amd64", "arm64"} {
+		m := image(t, repo)
+		d := put(t, repo, fmt.Sprintf("sha256:%x", sha256.Sum256(m)), ociManifest, m)
+		manifests = append(manifests, map[string]interface{}{
+			"mediaType": ociManifest,
+			"size":      len(m),
+			"digest":    d,
+			"platform":  map[string]string{"architecture": arch, "os": "linux"},
+		})
+		digests = append(digests, d)
+	}
+	idx, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociIndex,
+		"manifests":     manifests,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return put(t, repo, tag, ociIndex, idx), digests
+}
+
+// image uploads a new config blob to the fake registry, and returns the
+// manifest of an image with it.
+func image(t *testing.T, repo string) []byte {
+	t.Helper()
+	config := []byte(fmt.Sprintf(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]},"config":{"Labels":{"nonce":"%d"}}}`, atomic.AddInt64(&nonce, 1)))
+	configDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(config))
+	upload(t, http.MethodPost, fmt.Sprintf("/v2/%s/blobs/uploads/?digest=%s", repo, configDigest), "application/octet-stream", config)
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociManifest,
+		"config": map[string]interface{}{
+			"mediaType": "application/vnd.oci.image.config.v1+json",
+			"size":      len(config),
+			"digest":    configDigest,
+		},
+		"layers": []interface{}{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+// put uploads the manifest to the fake registry as repo:ref, and returns its
+// digest.
+func put(t *testing.T, repo, ref, mediaType string, manifest []byte) string {
+	t.Helper()
+	upload(t, http.MethodPut, fmt.Sprintf("/v2/%s/manifests/%s", repo, ref), mediaType, manifest)
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(manifest))
+}
+
+func upload(t *testing.T, method, path, contentType string, body []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, "https://"+registryHost+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+fakeToken)
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		b, _ := io.ReadAll(resp.Body)
+		t.Fatalf("%s %s: %d %s", method, path, resp.StatusCode, b)
+	}
+}
+
+// pull requests the manifest from the fake registry through the handler.
+func pull(h http.Handler, method, repo, ref string, opts ...func(*http.Request)) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, fmt.Sprintf("/v2/%s/%s/manifests/%s", registryHost, repo, ref), nil)
+	for _, o := range opts {
+		o(req)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func testTag(t *testing.T, repo, tag string) name.Tag {
+	t.Helper()
+	tt, err := name.NewTag(fmt.Sprintf("%s/%s:%s", registryHost, repo, tag))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tt
+}
+
+// pins returns the sorted digests the tag has been pinned to in the fake
+// Rekor.
+func pins(t *testing.T, repo, tag string) []string {
+	t.Helper()
+	var out []string
+	for _, p := range sigstore.predicates(rekor.IndexKey(testTag(t, repo, tag))) {
+		out = append(out, fmt.Sprint(p["digest"]))
+	}
+	sort.Strings(out)
+	return out
+}
+
+func checkPins(t *testing.T, repo, tag string, want ...string) {
+	t.Helper()
+	sort.Strings(want)
+	if got := pins(t, repo, tag); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("pins for %s:%s = %v, want %v", repo, tag, got, want)
+	}
+}
+
+func checkStatus(t *testing.T, w *httptest.ResponseRecorder, want int, code string) {
+	t.Helper()
+	if w.Code != want {
+		t.Fatalf("status = %d, want %d: %s", w.Code, want, w.Body)
+	}
+	if code != "" && !strings.Contains(w.Body.String(), fmt.Sprintf("%q", code)) {
+		t.Errorf("body = %s, want error code %s", w.Body, code)
+	}
+}
+
+func TestFirstSeen(t *testing.T) {
+	h := http.HandlerFunc(handler)
+	repo := "test/first-seen"
+	digest := push(t, repo, "latest")
+
+	w := pull(h, http.MethodGet, repo, "latest")
+	checkStatus(t, w, http.StatusOK, "")
+	if got := w.Header().Get("Docker-Content-Digest"); got != digest {
+		t.Errorf("Docker-Content-Digest = %q, want %q", got, digest)
+	}
+	if got := w.Header().Get("TLog-First-Seen"); got != "true" {
+		t.Errorf("TLog-First-Seen = %q, want true", got)
+	}
+	if w.Header().Get("TLog-UUID") == "" {
+		t.Error("TLog-UUID is missing")
+	}
+	if w.Body.Len() == 0 {
+		t.Error("manifest is missing")
+	}
+	checkPins(t, repo, "latest", digest)
+}
+
+func TestPinned(t *testing.T) {
+	h := http.HandlerFunc(handler)
+	repo := "test/pinned"
+	digest := push(t, repo, "latest")
+
+	first := pull(h, http.MethodGet, repo, "latest")
+	checkStatus(t, first, http.StatusOK, "")
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		w := pull(h, method, repo, "latest")
+		checkStatus(t, w, http.StatusOK, "")
+		if got := w.Header().Get("TLog-First-Seen"); got != "" {
+			t.Errorf("%s: TLog-First-Seen = %q, want none", method, got)
+		}
+		if got, want := w.Header().Get("TLog-UUID"), first.Header().Get("TLog-UUID"); got != want {
+			t.Errorf("%s: TLog-UUID = %q, want %q", method, got, want)
+		}
+	}
+	checkPins(t, repo, "latest", digest)
+}
+
+func TestPendingIntegration(t *testing.T) {
+	h := http.HandlerFunc(handler)
+	repo := "test/pending"
+	digest := push(t, repo, "latest")
+
+	sigstore.setIndexing(false)
+	defer sigstore.setIndexing(true)
+	checkStatus(t, pull(h, http.MethodGet, repo, "latest"), http.StatusOK, "")
+	w := pull(h, http.MethodGet, repo, "latest")
+	checkStatus(t, w, http.StatusOK, "")
+	if got := w.Header().Get("TLog-First-Seen"); got != "" {
+		t.Errorf("TLog-First-Seen = %q, want none", got)
+	}
+	checkPins(t, repo, "latest", digest)
+}
+
+func TestMismatch(t *testing.T) {
+	h := http.HandlerFunc(handler)
+	repo := "test/mismatch"
+	pinned := push(t, repo, "latest")
+	checkStatus(t, pull(h, http.MethodGet, repo, "latest"), http.StatusOK, "")
+
+	// The tag is moved upstream.
+	moved := push(t, repo, "latest")
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		checkStatus(t, pull(h, method, repo, "latest"), http.StatusBadRequest, "TAG_INVALID")
+	}
+	w := pull(h, http.MethodGet, repo, "latest")
+	var body struct {
+		Errors []struct {
+			Detail mismatchReport `json:"detail"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || len(body.Errors) != 1 {
+		t.Fatalf("parsing error %s: %v", w.Body, err)
+	}
+	report := body.Errors[0].Detail
+	if report.Got != moved || report.Pinned != pinned {
+		t.Errorf("report digests = %q, %q, want %q, %q", report.Got, report.Pinned, moved, pinned)
+	}
+	if report.UUID == "" || report.PinnedAt.IsZero() || !strings.HasSuffix(report.EntryURL, report.UUID) {
+		t.Errorf("report doesn't describe the pin: %+v", report)
+	}
+	if len(report.Actions) == 0 || !strings.Contains(report.Actions[0], "@"+pinned) {
+		t.Errorf("report actions = %q, want pulling %s", report.Actions, pinned)
+	}
+	// Requests by digest aren't pinned.
+	checkStatus(t, pull(h, http.MethodGet, repo, moved), http.StatusOK, "")
+	checkPins(t, repo, "latest", pinned)
+}
+
+func TestServePinned(t *testing.T) {
+	defaultMismatchPolicy = config.ServePinned
+	defer func() { defaultMismatchPolicy = config.Enforce }()
+
+	h := http.HandlerFunc(handler)
+	repo := "test/serve-pinned"
+	pinned := push(t, repo, "latest")
+	want := pull(h, http.MethodGet, repo, "latest").Body.Bytes()
+
+	// The tag is moved upstream, but clients still get the pinned manifest.
+	push(t, repo, "latest")
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		w := pull(h, method, repo, "latest")
+		checkStatus(t, w, http.StatusOK, "")
+		if got := w.Header().Get("Docker-Content-Digest"); got != pinned {
+			t.Errorf("%s: Docker-Content-Digest = %q, want %q", method, got, pinned)
+		}
+		if got := w.Header().Get("TLog-Mismatch"); got != pinned {
+			t.Errorf("%s: TLog-Mismatch = %q, want %q", method, got, pinned)
+		}
+		if method == http.MethodGet && !bytes.Equal(w.Body.Bytes(), want) {
+			t.Errorf("GET: body = %s, want %s", w.Body, want)
+		}
+	}
+	checkPins(t, repo, "latest", pinned)
+}
+
+func TestVerifyChildren(t *testing.T) {
+	verifyChildren = true
+	defer func() { verifyChildren = false }()
+
+	h := http.HandlerFunc(handler)
+	repo := "test/verify-children"
+	_, children := pushIndex(t, repo, "latest")
+	w := pull(h, http.MethodGet, repo, "latest", withAccept([]string{ociIndex}))
+	checkStatus(t, w, http.StatusOK, "")
+	want := []string{
+		children[0] + "; platform=linux/amd64; status=ok",
+		children[1] + "; platform=linux/arm64; status=ok",
+	}
+	if got := w.Header().Values("TLog-Child"); !reflect.DeepEqual(got, want) {
+		t.Errorf("TLog-Child = %q, want %q", got, want)
+	}
+	var idx struct {
+		Manifests []interface{} `json:"manifests"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &idx); err != nil || len(idx.Manifests) != 2 {
+		t.Errorf("body = %s, want the index: %v", w.Body, err)
+	}
+}
+
+func TestMaxManifestSize(t *testing.T) {
+	defer func(n int64) { maxManifestSize = n }(maxManifestSize)
+	maxManifestSize = 16
+
+	h := http.HandlerFunc(handler)
+	repo := "test/max-manifest-size"
+	push(t, repo, "latest")
+	checkStatus(t, pull(h, http.MethodGet, repo, "latest"), http.StatusBadGateway, "MANIFEST_INVALID")
+}
+
+func TestCopyManifest(t *testing.T) {
+	m := []byte(`{"schemaVersion":2}`)
+	digest, _ := digests.Of("sha256", m)
+	for _, c := range []struct {
+		desc    string
+		digest  string
+		limit   int64
+		wantErr bool
+	}{
+		{"ok", digest, 1 << 10, false},
+		{"mismatch", "sha256:" + strings.Repeat("0", 64), 1 << 10, true},
+		{"too large", digest, 8, true},
+	} {
+		t.Run(c.desc, func(t *testing.T) {
+			defer func(n int64) { maxManifestSize = n }(maxManifestSize)
+			maxManifestSize = c.limit
+			var buf bytes.Buffer
+			if err := copyManifest(&buf, bytes.NewReader(m), c.digest); (err != nil) != c.wantErr {
+				t.Errorf("copyManifest: %v, want error %t", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestWhoHas(t *testing.T) {
+	h := http.HandlerFunc(handler)
+	repo := "test/whohas"
+	m := image(t, repo)
+	digest := put(t, repo, "v1", ociManifest, m)
+	put(t, repo, "v1.0", ociManifest, m)
+	for _, tag := range []string{"v1", "v1.0"} {
+		checkStatus(t, pull(h, http.MethodGet, repo, tag), http.StatusOK, "")
+	}
+
+	w := httptest.NewRecorder()
+	handleWhoHas(w, httptest.NewRequest(http.MethodGet, "/api/v1/whohas?digest="+digest, nil))
+	checkStatus(t, w, http.StatusOK, "")
+	var got whoHas
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	var tags []string
+	for _, p := range got.Tags {
+		tags = append(tags, p.Tag)
+	}
+	want := []string{rekor.Canonical(testTag(t, repo, "v1")), rekor.Canonical(testTag(t, repo, "v1.0"))}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags = %q, want %q", tags, want)
+	}
+
+	w = httptest.NewRecorder()
+	handleWhoHas(w, httptest.NewRequest(http.MethodGet, "/api/v1/whohas?digest=latest", nil))
+	checkStatus(t, w, http.StatusBadRequest, "")
+}
+
+func TestTagsForDigest(t *testing.T) {
+	h := http.HandlerFunc(handler)
+	repo := "test/tags-for-digest"
+	m := image(t, repo)
+	digest := put(t, repo, "v1", ociManifest, m)
+	put(t, repo, "v1.0", ociManifest, m)
+	checkStatus(t, pull(h, http.MethodGet, repo, "v1"), http.StatusOK, "")
+	// This pin isn't searchable in Rekor yet, but it's in the local index.
+	sigstore.setIndexing(false)
+	checkStatus(t, pull(h, http.MethodGet, repo, "v1.0"), http.StatusOK, "")
+	sigstore.setIndexing(true)
+
+	for _, ref := range []string{digest, strings.TrimPrefix(digest, "sha256:")} {
+		w := httptest.NewRecorder()
+		handleTagsForDigest(w, httptest.NewRequest(http.MethodGet, "/api/v1/tags-for-digest/"+ref, nil))
+		checkStatus(t, w, http.StatusOK, "")
+		var got whoHas
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		var tags []string
+		for _, p := range got.Tags {
+			tags = append(tags, p.Tag)
+		}
+		want := []string{rekor.Canonical(testTag(t, repo, "v1")), rekor.Canonical(testTag(t, repo, "v1.0"))}
+		if got.Digest != digest || got.Partial || !reflect.DeepEqual(tags, want) {
+			t.Errorf("%s: got %+v, want %s pinned by %q", ref, got, digest, want)
+		}
+	}
+}
+
+func TestMultipleDigests(t *testing.T) {
+	h := http.HandlerFunc(handler)
+	repo := "test/multiple"
+	first := push(t, repo, "latest")
+	checkStatus(t, pull(h, http.MethodGet, repo, "latest"), http.StatusOK, "")
+
+	// Somehow, we pinned the tag to another digest too.
+	second := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("another manifest")))
+	if _, err := rekor.Put(context.Background(), testTag(t, repo, "latest"), second, nil); err != nil {
+		t.Fatalf("rekor.Put: %v", err)
+	}
+	checkPins(t, repo, "latest", first, second)
+	checkStatus(t, pull(h, http.MethodGet, repo, "latest"), http.StatusInternalServerError, "INTERNAL_ERROR")
+}
+
+func TestReadOnly(t *testing.T) {
+	h := http.HandlerFunc(handler)
+	checkStatus(t, pull(h, http.MethodPut, "test/read-only", "latest"), http.StatusMethodNotAllowed, "DENIED")
+}
+
+func TestAuth(t *testing.T) {
+	h := auth.Middleware(http.HandlerFunc(handler), func(w http.ResponseWriter) {
+		serveError(w, regError{status: http.StatusUnauthorized, Code: "UNAUTHORIZED", Message: "authentication required"})
+	})
+	repo := "test/auth"
+	digest := push(t, repo, "latest")
+
+	w := pull(h, http.MethodGet, repo, "latest")
+	checkStatus(t, w, http.StatusUnauthorized, "UNAUTHORIZED")
+	if w.Header().Get("WWW-Authenticate") == "" {
+		t.Error("WWW-Authenticate is missing")
+	}
+	checkStatus(t, pull(h, http.MethodGet, repo, "latest", func(r *http.Request) {
+		r.SetBasicAuth(testKeyID, "wrong")
+	}), http.StatusUnauthorized, "UNAUTHORIZED")
+	checkPins(t, repo, "latest")
+
+	checkStatus(t, pull(h, http.MethodGet, repo, "latest", func(r *http.Request) {
+		r.SetBasicAuth(testKeyID, testKey)
+	}), http.StatusOK, "")
+	checkPins(t, repo, "latest", digest)
+	ps := sigstore.predicates(rekor.IndexKey(testTag(t, repo, "latest")))
+	if got, want := ps[0]["principal"], "apikey:"+testKeyID; got != want {
+		t.Errorf("principal = %v, want %q", got, want)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Kinds of registry API routes.
+const (
+	kindManifests = "manifests"
+	kindBlobs     = "blobs"
+	kindTags      = "tags"
+	kindUploads   = "uploads"
+)
+
+var (
+	// From the OCI distribution spec.
+	componentRE = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*$`)
+	tagRE       = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+	digestRE    = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+
+	// A registry host, e.g., example.biz or localhost:5000.
+	hostRE = regexp.MustCompile(`^[a-zA-Z0-9](?:[a-zA-Z0-9.-]*[a-zA-Z0-9])?(?::[0-9]+)?$`)
+)
+
+// route is a parsed registry API request path.
+type route struct {
+	repo string // e.g., ubuntu or example.biz/foo/bar
+	kind string // one of the kind* constants
+	ref  string // tag or digest for manifests and blobs, session ID for uploads
+}
+
+// isDigest reports whether the route's reference is a digest.
+func (r route) isDigest() bool { return digestRE.MatchString(r.ref) }
+
+// suffix returns the part of the path after the repository.
+func (r route) suffix() string {
+	switch r.kind {
+	case kindTags:
+		return "tags/list"
+	case kindUploads:
+		return strings.TrimSuffix("blobs/uploads/"+r.ref, "/")
+	default:
+		return r.kind + "/" + r.ref
+	}
+}
+
+// path returns the request path for the route.
+func (r route) path() string { return "/v2/" + r.repo + "/" + r.suffix() }
+
+// parseRoute parses a /v2/... request path.
+//
+// Repository names may contain segments that look like API routes (e.g.,
+// example.biz/foo/manifests/bar), so the route is matched from the end of the
+// path, and the rest must be a valid repository name.
+func parseRoute(path string) (route, error) {
+	if !strings.HasPrefix(path, "/v2/") {
+		return route{}, errors.New("path must start with /v2/")
+	}
+	parts := strings.Split(strings.TrimPrefix(path, "/v2/"), "/")
+	n := len(parts)
+
+	var r route
+	var nameParts []string
+	switch {
+	case n >= 3 && parts[n-2] == kindTags && parts[n-1] == "list":
+		r.kind, nameParts = kindTags, parts[:n-2]
+	case n >= 3 && parts[n-2] == kindBlobs && parts[n-1] == kindUploads:
+		r.kind, nameParts = kindUploads, parts[:n-2]
+	case n >= 4 && parts[n-3] == kindBlobs && parts[n-2] == kindUploads:
+		r.kind, r.ref, nameParts = kindUploads, parts[n-1], parts[:n-3]
+	case n >= 3 && parts[n-2] == kindManifests:
+		r.kind, r.ref, nameParts = kindManifests, parts[n-1], parts[:n-2]
+		if !tagRE.MatchString(r.ref) && !digestRE.MatchString(r.ref) {
+			return route{}, fmt.Errorf("invalid reference %q", r.ref)
+		}
+	case n >= 3 && parts[n-2] == kindBlobs:
+		r.kind, r.ref, nameParts = kindBlobs, parts[n-1], parts[:n-2]
+		if !digestRE.MatchString(r.ref) {
+			return route{}, fmt.Errorf("invalid digest %q", r.ref)
+		}
+	default:
+		return route{}, fmt.Errorf("unknown route %q", path)
+	}
+
+	for i, p := range nameParts {
+		if componentRE.MatchString(p) {
+			continue
+		}
+		if i == 0 && len(nameParts) > 1 && hostRE.MatchString(p) {
+			continue // The first component may be a registry.
+		}
+		return route{}, fmt.Errorf("invalid repository name component %q", p)
+	}
+	r.repo = strings.Join(nameParts, "/")
+	return r, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import "testing"
+
+func TestParseRoute(t *testing.T) {
+	for _, c := range []struct {
+		path    string
+		want    route
+		wantErr bool
+	}{{
+		path: "/v2/ubuntu/manifests/latest",
+		want: route{repo: "ubuntu", kind: kindManifests, ref: "latest"},
+	}, {
+		path: "/v2/example.biz/foo/bar/manifests/v1.2.3",
+		want: route{repo: "example.biz/foo/bar", kind: kindManifests, ref: "v1.2.3"},
+	}, {
+		path: "/v2/example.biz/foo/manifests/bar/manifests/latest",
+		want: route{repo: "example.biz/foo/manifests/bar", kind: kindManifests, ref: "latest"},
+	}, {
+		path: "/v2/example.biz/manifests/blobs/sha256:abcd",
+		want: route{repo: "example.biz/manifests", kind: kindBlobs, ref: "sha256:abcd"},
+	}, {
+		path: "/v2/localhost:5000/foo/manifests/sha256:abcd",
+		want: route{repo: "localhost:5000/foo", kind: kindManifests, ref: "sha256:abcd"},
+	}, {
+		path: "/v2/foo/tags/list",
+		want: route{repo: "foo", kind: kindTags},
+	}, {
+		path: "/v2/foo/tags/tags/list",
+		want: route{repo: "foo/tags", kind: kindTags},
+	}, {
+		path: "/v2/foo/blobs/uploads/",
+		want: route{repo: "foo", kind: kindUploads},
+	}, {
+		path: "/v2/foo/blobs/uploads/some-session",
+		want: route{repo: "foo", kind: kindUploads, ref: "some-session"},
+	}, {
+		path:    "/v2/foo/manifests/",
+		wantErr: true,
+	}, {
+		path:    "/v2/Foo/manifests/latest",
+		wantErr: true,
+	}, {
+		path:    "/v2/foo/blobs/latest",
+		wantErr: true,
+	}, {
+		path:    "/v2/manifests/latest",
+		wantErr: true,
+	}, {
+		path:    "/v2/foo//manifests/latest",
+		wantErr: true,
+	}, {
+		path:    "/v2/example.biz/foo/bar",
+		wantErr: true,
+	}} {
+		t.Run(c.path, func(t *testing.T) {
+			got, err := parseRoute(c.path)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("parseRoute: got err %v, wantErr %t", err, c.wantErr)
+			}
+			if got != c.want {
+				t.Errorf("parseRoute: got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func FuzzParseRoute(f *testing.F) {
+	for _, p := range []string{
+		"/v2/ubuntu/manifests/latest",
+		"/v2/example.biz/foo/manifests/bar/manifests/latest",
+		"/v2/localhost:5000/foo/blobs/sha256:abcd",
+		"/v2/foo/tags/list",
+		"/v2/foo/blobs/uploads/abc",
+	} {
+		f.Add(p)
+	}
+	f.Fuzz(func(t *testing.T, path string) {
+		r, err := parseRoute(path)
+		if err != nil {
+			return
+		}
+		if r.repo == "" {
+			t.Fatalf("parseRoute(%q): empty repo", path)
+		}
+		// Parsing the route's path must produce the same route.
+		r2, err := parseRoute(r.path())
+		if err != nil {
+			t.Fatalf("parseRoute(%q): %v", r.path(), err)
+		}
+		if r2 != r {
+			t.Fatalf("parseRoute(%q) = %+v, then parseRoute(%q) = %+v", path, r, r.path(), r2)
+		}
+	})
+}
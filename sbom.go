@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// recordSBOM records the digest of the SBOM attached to an image in new pins.
+var recordSBOM bool
+
+const maxSBOMManifestSize = 4 << 20 // 4MB
+
+// sbomArtifactTypes are the artifact types of SBOMs attached as referrers.
+var sbomArtifactTypes = map[string]bool{
+	"application/spdx+json":            true,
+	"text/spdx":                        true,
+	"application/vnd.cyclonedx+json":   true,
+	"application/vnd.cyclonedx+xml":    true,
+	"application/vnd.syft+json":        true,
+	"application/vnd.dev.sbom.v1+json": true,
+}
+
+// sbomRecord identifies the SBOM attached to an image when it was first
+// pulled.
+type sbomRecord struct {
+	Source       string `json:"source"` // "referrers" or "tag".
+	Digest       string `json:"digest"` // of the SBOM artifact's manifest.
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+// sbom finds the SBOM attached to the manifest, either as a referrer or with
+// cosign's .sbom tag, or returns nil if it has none.
+func sbom(ctx context.Context, repo name.Repository, digest string) (*sbomRecord, error) {
+	rec, err := sbomReferrer(ctx, repo, digest)
+	if err != nil || rec != nil {
+		return rec, err
+	}
+
+	resp, err := fetch(ctx, repo, "manifests/"+strings.Replace(digest, ":", "-", 1)+".sbom",
+		"application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.docker.distribution.manifest.v2+json")
+	if errors.Is(err, errNotFound) {
+		return nil, nil // No SBOM.
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := readLimited(resp.Body, maxSBOMManifestSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading SBOM manifest: %w", err)
+	}
+	return &sbomRecord{
+		Source: "tag",
+		Digest: fmt.Sprintf("sha256:%x", sha256.Sum256(b)),
+	}, nil
+}
+
+// sbomReferrer finds an SBOM among the manifest's referrers, if the registry
+// supports the referrers API.
+func sbomReferrer(ctx context.Context, repo name.Repository, digest string) (*sbomRecord, error) {
+	resp, err := fetch(ctx, repo, "referrers/"+digest, "application/vnd.oci.image.index.v1+json")
+	if errors.Is(err, errNotFound) {
+		return nil, nil // Referrers API not supported.
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := readLimited(resp.Body, maxSBOMManifestSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading referrers: %w", err)
+	}
+	var idx struct {
+		Manifests []struct {
+			Digest       string `json:"digest"`
+			ArtifactType string `json:"artifactType"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, fmt.Errorf("decoding referrers: %w", err)
+	}
+	for _, m := range idx.Manifests {
+		if sbomArtifactTypes[m.ArtifactType] {
+			return &sbomRecord{Source: "referrers", Digest: m.Digest, ArtifactType: m.ArtifactType}, nil
+		}
+	}
+	return nil, nil
+}
+
+// errTooLarge is returned by readLimited if there's more than the limit.
+var errTooLarge = errors.New("too large")
+
+// readLimited reads up to limit bytes.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, fmt.Errorf("%w: exceeds %d bytes", errTooLarge, limit)
+	}
+	return b, nil
+}
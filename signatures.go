@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/chainguard-dev/tlogistry/internal/rekor"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// recordSignatures records a summary of upstream cosign signatures in new
+// pins.
+var recordSignatures bool
+
+const (
+	maxSignatures    = 16
+	maxSignatureSize = 64 << 10 // 64KB
+)
+
+// signatureSummary summarizes the cosign signatures of an image when it was
+// first pulled.
+type signatureSummary struct {
+	Verified   []rekor.Signature `json:"verified"`
+	Unverified int               `json:"unverified"`
+}
+
+// signatures finds and verifies the cosign signatures of the manifest, or
+// returns nil if it has none.
+func signatures(ctx context.Context, repo name.Repository, digest string) (*signatureSummary, error) {
+	resp, err := fetch(ctx, repo, "manifests/"+strings.Replace(digest, ":", "-", 1)+".sig",
+		"application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.docker.distribution.manifest.v2+json")
+	if errors.Is(err, errNotFound) {
+		return nil, nil // Not signed.
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := readLimited(resp.Body, maxSignatureSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading signature manifest: %w", err)
+	}
+	m, err := v1.ParseManifest(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("parsing signature manifest: %w", err)
+	}
+
+	s := &signatureSummary{Verified: []rekor.Signature{}}
+	for i, l := range m.Layers {
+		if i == maxSignatures {
+			s.Unverified += len(m.Layers) - i
+			break
+		}
+		payload, err := fetchBlob(ctx, repo, l.Digest.String(), maxSignatureSize)
+		if err != nil {
+			return nil, err
+		}
+		sig, err := rekor.VerifyCosign(digest, payload,
+			l.Annotations["dev.cosignproject.cosign/signature"],
+			l.Annotations["dev.sigstore.cosign/certificate"],
+			l.Annotations["dev.sigstore.cosign/chain"],
+			l.Annotations["dev.sigstore.cosign/bundle"])
+		if err != nil {
+			log.Printf("signature %s of %s@%s not verified: %v", l.Digest, repo, digest, err)
+			s.Unverified++
+			continue
+		}
+		s.Verified = append(s.Verified, *sig)
+	}
+	return s, nil
+}
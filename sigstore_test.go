@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-openapi/swag"
+	rmodels "github.com/sigstore/rekor/pkg/generated/models"
+)
+
+// fakeSigstore is an in-memory Fulcio and Rekor, just enough of them for
+// tlogistry to write pins and find them again.
+//
+// Fulcio issues certs for the email in any ID token, without verifying it.
+type fakeSigstore struct {
+	caKey   *ecdsa.PrivateKey
+	ca      *x509.Certificate
+	rootPEM []byte
+	logID   string
+
+	mu      sync.Mutex
+	entries map[string]*fakeEntry // by UUID
+	index   map[string][]string   // subject digest -> UUIDs
+	// unindexed, if set, leaves new entries out of the index, like Rekor
+	// before they're integrated.
+	unindexed bool
+}
+
+type fakeEntry struct {
+	body           []byte
+	payload        []byte
+	logIndex       int64
+	integratedTime int64
+}
+
+func newFakeSigstore() (*fakeSigstore, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake fulcio"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	logID := sha256.Sum256(der)
+	return &fakeSigstore{
+		caKey:   key,
+		ca:      ca,
+		rootPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		logID:   hex.EncodeToString(logID[:]),
+		entries: map[string]*fakeEntry{},
+		index:   map[string][]string{},
+	}, nil
+}
+
+func (f *fakeSigstore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/signingCert":
+		f.signingCert(w, r)
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/log/entries":
+		f.createEntry(w, r)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/api/v1/log/entries/"):
+		f.getEntry(w, path.Base(r.URL.Path))
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/index/retrieve":
+		f.search(w, r)
+	default:
+		fakeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func fakeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(rmodels.Error{Code: int64(status), Message: msg})
+}
+
+// oidIssuer is Fulcio's OIDC issuer extension.
+var oidIssuer = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+
+func (f *fakeSigstore) signingCert(w http.ResponseWriter, r *http.Request) {
+	var claims struct {
+		Issuer string `json:"iss"`
+		Email  string `json:"email"`
+	}
+	parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+	if len(parts) != 3 {
+		fakeError(w, http.StatusUnauthorized, "malformed token")
+		return
+	}
+	if b, err := base64.RawURLEncoding.DecodeString(parts[1]); err != nil || json.Unmarshal(b, &claims) != nil {
+		fakeError(w, http.StatusUnauthorized, "malformed token claims")
+		return
+	}
+	var cr struct {
+		PublicKey struct {
+			Content []byte `json:"content"`
+		} `json:"publicKey"`
+		SignedEmailAddress []byte `json:"signedEmailAddress"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&cr); err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	pub, err := x509.ParsePKIXPublicKey(cr.PublicKey.Content)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	epub, ok := pub.(*ecdsa.PublicKey)
+	h := sha256.Sum256([]byte(claims.Email))
+	if !ok || !ecdsa.VerifyASN1(epub, h[:], cr.SignedEmailAddress) {
+		fakeError(w, http.StatusBadRequest, "invalid proof of possession")
+		return
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:    big.NewInt(time.Now().UnixNano()),
+		NotBefore:       time.Now().Add(-time.Minute),
+		NotAfter:        time.Now().Add(10 * time.Minute),
+		EmailAddresses:  []string{claims.Email},
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		ExtraExtensions: []pkix.Extension{{Id: oidIssuer, Value: []byte(claims.Issuer)}},
+	}, f.ca, pub, f.caKey)
+	if err != nil {
+		fakeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Header().Set("SCT", base64.StdEncoding.EncodeToString([]byte("fake sct")))
+	w.WriteHeader(http.StatusCreated)
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	w.Write(f.rootPEM)
+}
+
+func (f *fakeSigstore) createEntry(w http.ResponseWriter, r *http.Request) {
+	var pe struct {
+		Kind string `json:"kind"`
+		Spec struct {
+			Content struct {
+				Envelope string `json:"envelope"`
+			} `json:"content"`
+			PublicKey []byte `json:"publicKey"`
+		} `json:"spec"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&pe); err != nil || pe.Kind != "intoto" {
+		fakeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported entry %q: %v", pe.Kind, err))
+		return
+	}
+	var envelope struct {
+		PayloadType string `json:"payloadType"`
+		Payload     []byte `json:"payload"`
+		Signatures  []struct {
+			Sig []byte `json:"sig"`
+		} `json:"signatures"`
+	}
+	if err := json.Unmarshal([]byte(pe.Spec.Content.Envelope), &envelope); err != nil || len(envelope.Signatures) != 1 {
+		fakeError(w, http.StatusBadRequest, fmt.Sprintf("malformed envelope: %v", err))
+		return
+	}
+	block, _ := pem.Decode(pe.Spec.PublicKey)
+	if block == nil {
+		fakeError(w, http.StatusBadRequest, "malformed public key")
+		return
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	pae := fmt.Sprintf("DSSEv1 %d %s %d %s", len(envelope.PayloadType), envelope.PayloadType, len(envelope.Payload), envelope.Payload)
+	h := sha256.Sum256([]byte(pae))
+	if !ok || !ecdsa.VerifyASN1(pub, h[:], envelope.Signatures[0].Sig) {
+		fakeError(w, http.StatusBadRequest, "invalid envelope signature")
+		return
+	}
+	var statement struct {
+		Subject []struct {
+			Digest map[string]string `json:"digest"`
+		} `json:"subject"`
+	}
+	if err := json.Unmarshal(envelope.Payload, &statement); err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	hexsum := func(b []byte) string {
+		h := sha256.Sum256(b)
+		return hex.EncodeToString(h[:])
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"apiVersion": "0.0.1",
+		"kind":       "intoto",
+		"spec": map[string]interface{}{
+			"content": map[string]interface{}{
+				"hash":        map[string]string{"algorithm": "sha256", "value": hexsum([]byte(pe.Spec.Content.Envelope))},
+				"payloadHash": map[string]string{"algorithm": "sha256", "value": hexsum(envelope.Payload)},
+			},
+			"publicKey": pe.Spec.PublicKey,
+		},
+	})
+	uuid := hexsum(append([]byte{0}, body...)) // The entry's leaf hash.
+	location := "/api/v1/log/entries/" + uuid
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("ETag", uuid)
+	w.Header().Set("Location", location)
+	if _, ok := f.entries[uuid]; ok {
+		fakeError(w, http.StatusConflict, "an equivalent entry already exists in the transparency log with UUID "+uuid)
+		return
+	}
+	e := &fakeEntry{
+		body:           body,
+		payload:        envelope.Payload,
+		logIndex:       int64(len(f.entries)),
+		integratedTime: time.Now().Unix(),
+	}
+	f.entries[uuid] = e
+	if !f.unindexed {
+		for _, s := range statement.Subject {
+			f.index[s.Digest["sha256"]] = append(f.index[s.Digest["sha256"]], uuid)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rmodels.LogEntry{uuid: f.anon(e, false)})
+}
+
+// anon returns the entry as Rekor serves it. Like Rekor, the attestation is
+// only included when the entry is fetched.
+func (f *fakeSigstore) anon(e *fakeEntry, attestation bool) rmodels.LogEntryAnon {
+	le := rmodels.LogEntryAnon{
+		Body:           base64.StdEncoding.EncodeToString(e.body),
+		IntegratedTime: swag.Int64(e.integratedTime),
+		LogID:          swag.String(f.logID),
+		LogIndex:       swag.Int64(e.logIndex),
+	}
+	if attestation {
+		le.Attestation = &rmodels.LogEntryAnonAttestation{Data: e.payload}
+	}
+	return le
+}
+
+func (f *fakeSigstore) getEntry(w http.ResponseWriter, uuid string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.entries[uuid]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "entry not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rmodels.LogEntry{uuid: f.anon(e, true)})
+}
+
+func (f *fakeSigstore) search(w http.ResponseWriter, r *http.Request) {
+	var q rmodels.SearchIndex
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	uuids := append([]string{}, f.index[strings.TrimPrefix(q.Hash, "sha256:")]...)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(uuids)
+}
+
+// setIndexing sets whether new entries are indexed.
+func (f *fakeSigstore) setIndexing(on bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unindexed = !on
+}
+
+// predicates returns the predicates of all entries whose subject has the
+// digest, indexed or not.
+func (f *fakeSigstore) predicates(digest string) []map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []map[string]interface{}
+	for _, e := range f.entries {
+		var statement struct {
+			Subject []struct {
+				Digest map[string]string `json:"digest"`
+			} `json:"subject"`
+			Predicate map[string]interface{} `json:"predicate"`
+		}
+		if err := json.Unmarshal(e.payload, &statement); err != nil {
+			continue
+		}
+		for _, s := range statement.Subject {
+			if s.Digest["sha256"] == digest {
+				out = append(out, statement.Predicate)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chainguard-dev/tlogistry/internal/config"
+)
+
+// validationTTL is how long a successful domain validation is trusted.
+const validationTTL = time.Hour
+
+var (
+	validatedMu sync.Mutex
+	validated   = map[string]time.Time{} // domain -> validation time
+)
+
+// vanityDomain returns the configuration for the vanity domain the request
+// was sent to, or nil if it wasn't sent to a vanity domain.
+//
+// Hosts that aren't configured as vanity domains are routed by their first
+// label, if it's configured as a subdomain; these are expected to be served
+// by a wildcard DNS record the operator controls, and aren't validated.
+//
+// Before a domain is served, whoever controls it must prove it, ACME DNS-01
+// style, by publishing its validation token in a TXT record at
+// _tlogistry-challenge.<domain>.
+func vanityDomain(ctx context.Context, host string) (*config.Domain, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	cfg := config.Get()
+	d, ok := cfg.Domains[host]
+	if !ok {
+		label := strings.SplitN(host, ".", 2)[0]
+		if reg, ok := cfg.Subdomains[label]; ok && label != host {
+			return &config.Domain{Registry: reg}, nil
+		}
+		return nil, nil
+	}
+
+	validatedMu.Lock()
+	at, ok := validated[host]
+	validatedMu.Unlock()
+	if ok && time.Since(at) < validationTTL {
+		return &d, nil
+	}
+
+	if d.ValidationToken == "" {
+		return nil, fmt.Errorf("domain %q has no validation token", host)
+	}
+	txts, err := net.DefaultResolver.LookupTXT(ctx, "_tlogistry-challenge."+host)
+	if err != nil {
+		return nil, fmt.Errorf("validating domain %q: %w", host, err)
+	}
+	for _, txt := range txts {
+		if txt == d.ValidationToken {
+			log.Printf("=== DOMAIN: validated %q", host)
+			validatedMu.Lock()
+			validated[host] = time.Now()
+			validatedMu.Unlock()
+			return &d, nil
+		}
+	}
+	return nil, fmt.Errorf("validating domain %q: validation token not found in TXT records", host)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chainguard-dev/tlogistry/internal/digests"
+	"github.com/chainguard-dev/tlogistry/internal/rekor"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// verifyForm is shown on the home page, and submits to handleVerify.
+const verifyForm = `<hr>
+<h2 id="verify">Verify a Pin</h2>
+<form action="/verify" method="get">
+<input type="text" name="image" placeholder="alpine:3.16.0" size="40">
+<input type="submit" value="Look up">
+</form>
+`
+
+// verification is what handleVerify reports about a tag's pin.
+type verification struct {
+	Tag            string    `json:"tag"`
+	Pinned         bool      `json:"pinned"`
+	Digest         string    `json:"digest,omitempty"`
+	UUID           string    `json:"uuid,omitempty"`
+	LogIndex       int64     `json:"logIndex,omitempty"`
+	IntegratedTime time.Time `json:"integratedTime,omitempty"`
+	EntryURL       string    `json:"entryURL,omitempty"`
+	Identity       string    `json:"identity"`
+	Commands       []string  `json:"commands"`
+}
+
+var verifyTmpl = template.Must(template.New("verify").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>tlogistry.dev: {{.Tag}}</title>
+<link rel="stylesheet" type="text/css" href="/style.css">
+</head>
+<body>
+<h1><code>{{.Tag}}</code></h1>
+{{if .Pinned}}<p>Pinned to <code>{{.Digest}}</code> since {{.IntegratedTime.Format "2006-01-02T15:04:05Z07:00"}}.</p>
+<ul>
+<li>Rekor entry: <a href="{{.EntryURL}}" target="_blank"><code>{{.UUID}}</code></a> (log index {{.LogIndex}})</li>
+<li>Signed by: <code>{{.Identity}}</code></li>
+</ul>
+{{else}}<p>This tag hasn't been pinned yet. It will be pinned the first time it's pulled through this registry.</p>
+{{end}}<h2>Check it yourself</h2>
+<pre>{{range .Commands}}{{.}}
+{{end}}</pre>
+<p><a href="/">Back</a></p>
+</body>
+</html>
+`))
+
+// handleVerify looks up the pin for the image:tag given in the "image" query
+// parameter, and reports how to independently check it.
+func handleVerify(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	image := strings.TrimSpace(r.URL.Query().Get("image"))
+	if image == "" {
+		http.Redirect(w, r, "/#verify", http.StatusFound)
+		return
+	}
+	tag, err := name.NewTag(image)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parsing tag: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	digest, info, err := rekor.Get(ctx, tag)
+	if err != nil {
+		log.Printf("!!! ERROR LOOKING UP %q: %v", tag, err)
+		http.Error(w, fmt.Sprintf("looking up digest for tag %q: %v", tag, err), http.StatusInternalServerError)
+		return
+	}
+
+	v := verification{
+		Tag:      tag.String(),
+		Identity: rekor.Identity(),
+		Commands: []string{
+			fmt.Sprintf("rekor-cli search --rekor_server %s --sha %s", rekor.URL(), rekor.IndexKey(tag)),
+		},
+	}
+	if digest != "" {
+		v.Pinned = true
+		v.Digest = digest
+		v.UUID = info.UUID
+		v.LogIndex = info.LogIndex
+		v.IntegratedTime = info.IntegratedTime.UTC()
+		v.EntryURL = fmt.Sprintf("%s/api/v1/log/entries/%s", rekor.URL(), info.UUID)
+		v.Commands = append(v.Commands,
+			fmt.Sprintf("rekor-cli get --rekor_server %s --uuid %s --format json", rekor.URL(), info.UUID),
+			fmt.Sprintf("rekor-cli verify --rekor_server %s --uuid %s", rekor.URL(), info.UUID),
+			fmt.Sprintf("crane digest %s", tag),
+		)
+	}
+
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			log.Printf("!!! ERROR WRITING VERIFICATION: %v", err)
+		}
+		return
+	}
+	if err := verifyTmpl.Execute(w, v); err != nil {
+		log.Printf("!!! ERROR WRITING VERIFICATION: %v", err)
+	}
+}
+
+// whoHas is what handleWhoHas and handleTagsForDigest report about the tags
+// pinned to a digest.
+type whoHas struct {
+	Digest string      `json:"digest"`
+	Tags   []tagPinned `json:"tags"`
+	// Partial is set if Rekor couldn't be searched, and only pins known to
+	// this instance are reported.
+	Partial bool `json:"partial,omitempty"`
+}
+
+type tagPinned struct {
+	Tag            string    `json:"tag"`
+	UUID           string    `json:"uuid"`
+	LogIndex       int64     `json:"logIndex"`
+	IntegratedTime time.Time `json:"integratedTime"`
+	EntryURL       string    `json:"entryURL"`
+}
+
+// handleWhoHas reports which tags have been pinned to the digest given in
+// the "digest" query parameter, for incident response when a digest turns
+// out to be malicious.
+func handleWhoHas(w http.ResponseWriter, r *http.Request) {
+	digest := strings.TrimSpace(r.URL.Query().Get("digest"))
+	if !digests.Valid(digest) {
+		http.Error(w, fmt.Sprintf("invalid digest %q", digest), http.StatusBadRequest)
+		return
+	}
+	pins, err := rekor.WhoHas(r.Context(), digest)
+	if err != nil {
+		log.Printf("!!! ERROR LOOKING UP TAGS FOR %q: %v", digest, err)
+		http.Error(w, fmt.Sprintf("looking up tags for digest %q: %v", digest, err), http.StatusInternalServerError)
+		return
+	}
+	writeTagPins(w, whoHas{Digest: digest}, pins)
+}
+
+// handleTagsForDigest reports which tags have been pinned to the digest at
+// the end of the path, /api/v1/tags-for-digest/<digest>, from this
+// instance's index of pins and Rekor. A bare hex digest's algorithm is
+// inferred from its length.
+func handleTagsForDigest(w http.ResponseWriter, r *http.Request) {
+	digest := strings.TrimPrefix(r.URL.Path, "/api/v1/tags-for-digest/")
+	if !strings.Contains(digest, ":") {
+		alg := "sha256"
+		if len(digest) == 128 {
+			alg = "sha512"
+		}
+		digest = alg + ":" + digest
+	}
+	if !digests.Valid(digest) {
+		http.Error(w, fmt.Sprintf("invalid digest %q", digest), http.StatusBadRequest)
+		return
+	}
+	pins, partial, err := rekor.TagsForDigest(r.Context(), digest)
+	if err != nil {
+		log.Printf("!!! ERROR LOOKING UP TAGS FOR %q: %v", digest, err)
+		http.Error(w, fmt.Sprintf("looking up tags for digest %q: %v", digest, err), http.StatusInternalServerError)
+		return
+	}
+	writeTagPins(w, whoHas{Digest: digest, Partial: partial}, pins)
+}
+
+// writeTagPins writes the report with the pins as JSON.
+func writeTagPins(w http.ResponseWriter, v whoHas, pins []rekor.TagPin) {
+	v.Tags = []tagPinned{}
+	for _, p := range pins {
+		v.Tags = append(v.Tags, tagPinned{
+			Tag:            p.Tag,
+			UUID:           p.UUID,
+			LogIndex:       p.LogIndex,
+			IntegratedTime: p.IntegratedTime.UTC(),
+			EntryURL:       fmt.Sprintf("%s/api/v1/log/entries/%s", rekor.URL(), p.UUID),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("!!! ERROR WRITING TAGS: %v", err)
+	}
+}